@@ -6,6 +6,7 @@ import { Button } from "@/components/ui/button"
 import { Input } from "@/components/ui/input"
 import { ArrowLeft, Send, MoreVertical } from "lucide-react"
 import { apiClient, Message } from "@/lib/api"
+import { useNotification, Envelope } from "@/contexts/NotificationContext"
 
 interface ChatMessage {
   _id: string
@@ -24,11 +25,12 @@ export default function ChatPage() {
   
   const [messages, setMessages] = useState<ChatMessage[]>([])
   const [newMessage, setNewMessage] = useState("")
-  const [isConnected, setIsConnected] = useState(false)
+  const { isConnected, setupNotificationSocket, subscribeRoom, sendEnvelope } = useNotification()
   const [roomInfo, setRoomInfo] = useState<{name: string, email: string} | null>(null)
   const [isLoading, setIsLoading] = useState(true)
   
-  const wsRef = useRef<WebSocket | null>(null)
+  const leaveRoomRef = useRef<(() => void) | null>(null)
+  const messagesRef = useRef<ChatMessage[]>([])
 
   const messagesEndRef = useRef<HTMLDivElement>(null)
   const currentUser = useRef<any>(null)
@@ -54,16 +56,15 @@ export default function ChatPage() {
     // Load initial messages and connect to websocket
     initializeChat()
     
-    // Cleanup on unmount
+    // Leave the room on unmount; the socket stays open for the app
     return () => {
-      if (wsRef.current) {
-        console.log('Closing WebSocket connection')
-        wsRef.current.close()
-      }
+      leaveRoomRef.current?.()
+      leaveRoomRef.current = null
     }
   }, [roomId, router])
 
   useEffect(() => {
+    messagesRef.current = messages
     scrollToBottom()
   }, [messages])
 
@@ -92,7 +93,8 @@ export default function ChatPage() {
       console.log('Room messages response:', response)
       
       if (response.data && Array.isArray(response.data)) {
-        const chatMessages: ChatMessage[] = response.data.map((msg: any) => ({
+        // The server pages newest first; the chat reads oldest first.
+        const chatMessages: ChatMessage[] = [...response.data].reverse().map((msg: any) => ({
           _id: msg._id,
           room_id: msg.room_id,
           content: msg.content,
@@ -119,80 +121,56 @@ export default function ChatPage() {
   }
 
 
+  // The room is joined on the app's shared socket. After a reconnect the
+  // provider subscribes again from the last message we have, so there is no
+  // gap.
   const connectWebSocket = () => {
-    const userId = currentUser.current?.id
-    const username = currentUser.current?.username || ""
-    const wsUrl = `${process.env.NEXT_PUBLIC_WS_URL || 'ws://localhost:8080'}/join_room/${roomId}?user_id=${userId}&username=${username}`
-   
-    console.log('Connecting to WebSocket:', wsUrl)
-    
-    try {
-      wsRef.current = new WebSocket(wsUrl)
+    setupNotificationSocket(currentUser.current?.id)
+    leaveRoomRef.current?.()
+    leaveRoomRef.current = subscribeRoom(roomId, () => {
+      const loaded = messagesRef.current
+      return loaded.length > 0 ? loaded[loaded.length - 1]._id : undefined
+    }, handleEnvelope)
+  }
+
+  const handleEnvelope = (envelope: Envelope) => {
+    if (envelope.type !== 'message') {
+      return
+    }
+    const message = envelope.payload
+    const chatMessage: ChatMessage = {
+      _id: message._id,
+      room_id: message.room_id,
+      content: message.content,
+      username: message.username,
+      user_id: message.user_id,
+      created_at: message.created_at,
+      isOwn: message.user_id === currentUser.current?.id
+    }
     
-      wsRef.current.onopen = () => {
-        console.log('WebSocket connected successfully')
-        setIsConnected(true)
+    setMessages(prev => {
+      // A replayed message may already be in the loaded history.
+      if (prev.some(m => m._id === chatMessage._id)) {
+        return prev
       }
-      
-      wsRef.current.onmessage = (event) => {
-        console.log('Raw WebSocket message received:', event.data)
-        try {
-          const message = JSON.parse(event.data)
-          console.log('Parsed message:', message)
-          const chatMessage: ChatMessage = {
-            _id: message._id,
-            room_id: message.room_id,
-            content: message.content,
-            username: message.username,
-            user_id: message.user_id,
-            created_at: message.created_at,
-            isOwn: message.user_id === currentUser.current?.id
-          }
-          
-          console.log('Adding message to chat:', chatMessage)
-          setMessages(prev => {
-            console.log('Previous messages:', prev)
-            const newMessages = [...prev, chatMessage]
-            console.log('New messages array:', newMessages)
-            return newMessages
-          })
-        } catch (error) {
-          console.error('Error parsing message:', error)
-        }
-      }
-      
-      wsRef.current.onclose = (event) => {
-        console.log('WebSocket disconnected. Code:', event.code, 'Reason:', event.reason)
-        setIsConnected(false)
-        
-        // Attempt to reconnect after 3 seconds
-        setTimeout(() => {
-          if (wsRef.current?.readyState === WebSocket.CLOSED) {
-            console.log('Attempting to reconnect WebSocket...')
-            connectWebSocket()
-          }
-        }, 3000)
-      }
-      
-      wsRef.current.onerror = (error) => {
-        console.error('WebSocket error:', error)
-        setIsConnected(false)
-      }
-    } catch (error) {
-      console.error('Error creating WebSocket connection:', error)
-    }
+      return [...prev, chatMessage]
+    })
   }
 
   const sendMessage = () => {
-    if (!newMessage.trim() || !wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
-      console.log('Cannot send message. Message empty:', !newMessage.trim(), 'WebSocket ready:', wsRef.current?.readyState === WebSocket.OPEN)
+    if (!newMessage.trim() || !isConnected) {
+      console.log('Cannot send message. Message empty:', !newMessage.trim(), 'WebSocket ready:', isConnected)
       return
     }
     
    
     
     try {
-      wsRef.current.send(newMessage.trim())
+      sendEnvelope('message', {
+        room_id: roomId,
+        content: newMessage.trim(),
+        client_id: `${Date.now()}-${Math.random().toString(36).slice(2)}`,
+      })
       setNewMessage("")
     } catch (error) {
       console.error('Error sending message:', error)
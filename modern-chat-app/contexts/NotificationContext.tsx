@@ -11,10 +11,25 @@ interface NotificationData {
   Type: string
 }
 
+// Envelope is every frame on the socket: { v, type, id, payload }.
+export interface Envelope {
+  v: number
+  type: string
+  id?: string
+  payload: any
+}
+
+type EnvelopeListener = (envelope: Envelope) => void
+
 interface NotificationContextType {
   onlineRef: React.MutableRefObject<WebSocket | null>
   setupNotificationSocket: (userId: string) => void
   closeNotificationSocket: () => void
+  // subscribeRoom joins a room on the shared socket, again after every
+  // reconnect, asking for everything after since(). It returns a function
+  // that leaves the room.
+  subscribeRoom: (roomId: string, since: () => string | undefined, listener: EnvelopeListener) => () => void
+  sendEnvelope: (type: string, payload: any) => void
   isConnected: boolean
 }
 
@@ -25,13 +40,15 @@ export function NotificationProvider({ children }: { children: React.ReactNode }
   const [isConnected, setIsConnected] = useState(false)
   const onlineRef = useRef<WebSocket | null>(null)
   const currentUserIdRef = useRef<string | null>(null)
+  const roomsRef = useRef(new Map<string, { since: () => string | undefined, listener: EnvelopeListener }>())
   const router = useRouter()
 
   const setupNotificationSocket = (userId: string) => {
     if (!userId) return
 
     // Avoid duplicate connections for the same user
-    if (currentUserIdRef.current === userId && isConnected && onlineRef.current?.readyState === WebSocket.OPEN) {
+    const state = onlineRef.current?.readyState
+    if (currentUserIdRef.current === userId && (state === WebSocket.OPEN || state === WebSocket.CONNECTING)) {
       console.log('WebSocket already connected for user:', userId)
       return
     }
@@ -43,27 +60,42 @@ export function NotificationProvider({ children }: { children: React.ReactNode }
       onlineRef.current.close(1000, 'Reconnecting')
     }
 
-    const onlineUrl = `${process.env.NEXT_PUBLIC_WS_URL || 'ws://localhost:8080'}/ws/join_app?user_id=${userId}`
+    // One socket per tab. The token goes in the subprotocol list rather
+    // than the URL so it stays out of access logs.
+    const token = localStorage.getItem('token') || ""
+    const onlineUrl = `${process.env.NEXT_PUBLIC_WS_URL || 'ws://localhost:8080'}/ws`
     
     try {
-      onlineRef.current = new WebSocket(onlineUrl)
+      onlineRef.current = new WebSocket(onlineUrl, ['bearer', token])
       
       onlineRef.current.onopen = () => {
-        console.log('Notification WebSocket connected')
+        console.log('WebSocket connected')
         setIsConnected(true)
+        roomsRef.current.forEach((room, roomId) => {
+          sendEnvelope('subscribe', { room_id: roomId, since: room.since() })
+        })
       }
       
       onlineRef.current.onmessage = (event) => {
         try {
-          const data = JSON.parse(event.data)
-          console.log('Notification received:', data)
+          const envelope: Envelope = JSON.parse(event.data)
+          const data = envelope.payload
+          const room = data?.room_id ? roomsRef.current.get(data.room_id) : undefined
+          if (room) {
+            room.listener(envelope)
+          }
+          if (envelope.type === "error") {
+            console.error('WebSocket error frame:', data)
+          }
           
-          if (data.type === "notification") {
-            setNotification(data)
+          if (envelope.type === "notification") {
+            setNotification({ ...data, UserId: data.user_id, Content: data.content, Username: data.username, Type: envelope.type })
           }
           
           // Dispatch online status updates for home page
-          window.dispatchEvent(new CustomEvent('onlineStatusUpdate', { detail: data }))
+          if (envelope.type === "presence") {
+            window.dispatchEvent(new CustomEvent('onlineStatusUpdate', { detail: data }))
+          }
         } catch (error) {
           console.error('Error parsing notification:', error)
         }
@@ -98,6 +130,21 @@ export function NotificationProvider({ children }: { children: React.ReactNode }
     }
   }
 
+  const sendEnvelope = (type: string, payload: any) => {
+    if (onlineRef.current?.readyState === WebSocket.OPEN) {
+      onlineRef.current.send(JSON.stringify({ v: 1, type, id: `${Date.now()}`, payload }))
+    }
+  }
+
+  const subscribeRoom = (roomId: string, since: () => string | undefined, listener: EnvelopeListener) => {
+    roomsRef.current.set(roomId, { since, listener })
+    sendEnvelope('subscribe', { room_id: roomId, since: since() })
+    return () => {
+      roomsRef.current.delete(roomId)
+      sendEnvelope('unsubscribe', { room_id: roomId })
+    }
+  }
+
   const closeNotificationSocket = () => {
     setIsConnected(false)
     currentUserIdRef.current = null
@@ -143,6 +190,8 @@ export function NotificationProvider({ children }: { children: React.ReactNode }
       onlineRef, 
       setupNotificationSocket, 
       closeNotificationSocket,
+      subscribeRoom,
+      sendEnvelope,
       isConnected
     }}>
       {children}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"chat-server/db"
 	"chat-server/internal/ws"
 	"chat-server/routes"
+	"chat-server/tokens"
 	"log"
 	"os"
 
@@ -41,6 +43,10 @@ func main() {
 	config.AddAllowHeaders("Authorization", "Content-Type", "Origin", "Accept", "X-Requested-With")
 	config.AddAllowMethods("GET", "POST", "PUT", "DELETE", "OPTIONS")
 	router.Use(cors.New(config))
+	db.Ping(db.Client)
+	tokens.RequireSecret()
+	db.MergeDirectConversations(db.Client)
+	db.CreateIndexes(db.Client)
 	h := ws.NewHub()
 	go h.Run()
 	routes.ChatRoutes(router, h)
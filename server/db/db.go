@@ -11,14 +11,20 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// DBSet creates the client for DATABASE_URI, read from .env or the
+// environment; without one the driver's default of localhost is used. The
+// driver connects on first use, so the server calls Ping at startup to fail
+// fast when MongoDB is unreachable.
 func DBSet() *mongo.Client {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file:", err)
-		return nil
+		log.Println("No .env file, reading settings from the environment")
+	}
+	opts := options.Client()
+	if DATABASE_URI := os.Getenv("DATABASE_URI"); DATABASE_URI != "" {
+		opts.ApplyURI(DATABASE_URI)
 	}
-	var DATABASE_URI = os.Getenv("DATABASE_URI")
-	client, err := mongo.NewClient(options.Client().ApplyURI(DATABASE_URI))
+	client, err := mongo.NewClient(opts)
 	if err != nil {
 		log.Fatal("Error creating MongoDB client:", err)
 		return nil
@@ -31,13 +37,17 @@ func DBSet() *mongo.Client {
 		log.Fatal("Error connecting to MongoDB:", err)
 		return nil
 	}
-	err = client.Ping(ctx, nil)
-	if err != nil {
+	return client
+}
+
+// Ping stops the server if MongoDB cannot be reached.
+func Ping(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
 		log.Fatal("Error connecting to MongoDB:", err)
-		return nil
 	}
 	log.Println("Connected to MongoDB successfully")
-	return client
 }
 
 var Client *mongo.Client = DBSet()
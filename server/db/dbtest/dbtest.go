@@ -0,0 +1,47 @@
+// Package dbtest gives tests a scratch MongoDB database. Tests that need one
+// are skipped unless TEST_MONGO_URI is set; make test-mongo sets it.
+package dbtest
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Database connects to TEST_MONGO_URI and returns a new database that is
+// dropped when the test ends.
+func Database(t testing.TB) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGO_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := client.Database("Chat_App_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return database
+}
+
+// Use points each collection variable at the collection of the same name in
+// database, and restores them when the test ends.
+func Use(t testing.TB, database *mongo.Database, collections map[string]**mongo.Collection) {
+	t.Helper()
+	for name, collection := range collections {
+		previous := *collection
+		*collection = database.Collection(name)
+		t.Cleanup(func() { *collection = previous })
+	}
+}
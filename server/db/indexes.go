@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateIndexes makes sure the indexes the handlers rely on exist. It is
+// safe to call on every start; existing indexes are left alone.
+func CreateIndexes(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	indexes := map[string][]mongo.IndexModel{
+		"messages": {
+			{
+				Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+				Options: options.Index().SetName("room_history"),
+			},
+			{
+				Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "client_id", Value: 1}},
+				Options: options.Index().SetName("client_id").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"client_id": bson.M{"$type": "string"}}),
+			},
+			{
+				Keys:    bson.D{{Key: "content", Value: "text"}},
+				Options: options.Index().SetName("content_text"),
+			},
+			{
+				Keys: bson.D{{Key: "thread_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+				Options: options.Index().SetName("thread_history").
+					SetPartialFilterExpression(bson.M{"thread_id": bson.M{"$type": "string"}}),
+			},
+		},
+		// Backplane events are only needed while the other nodes catch up.
+		"hub_events": {
+			{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetName("expire").SetExpireAfterSeconds(300),
+			},
+		},
+		"conversations": {
+			{
+				Keys:    bson.D{{Key: "room_id", Value: 1}},
+				Options: options.Index().SetName("room_id").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "participants.id", Value: 1}},
+				Options: options.Index().SetName("participant"),
+			},
+			{
+				Keys: bson.D{{Key: "direct_key", Value: 1}},
+				Options: options.Index().SetName("direct_key").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"direct_key": bson.M{"$type": "string"}}),
+			},
+		},
+		"attachments": {
+			{
+				Keys:    bson.D{{Key: "key", Value: 1}},
+				Options: options.Index().SetName("key"),
+			},
+		},
+	}
+	for collection, models := range indexes {
+		_, err := client.Database("Chat_App").Collection(collection).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			log.Println("Error creating indexes on", collection+":", err)
+		}
+	}
+}
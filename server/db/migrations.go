@@ -0,0 +1,215 @@
+package db
+
+import (
+	"chat-server/models"
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mergeLock is the migrations document instances take turns holding while
+// they merge, so replicas starting together do not merge the same pair.
+const mergeLock = "merge_direct_conversations"
+
+// MergeDirectConversations gives every one-to-one conversation its
+// direct_key, folding conversations that duplicate the same pair of users
+// into the oldest one, messages included. It must run before CreateIndexes
+// builds the unique direct_key index, and does nothing once every direct
+// conversation has a key.
+func MergeDirectConversations(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	migrations := client.Database("Chat_App").Collection("migrations")
+	owner := primitive.NewObjectID().Hex()
+	if err := acquireLock(ctx, migrations, mergeLock, owner); err != nil {
+		log.Println("Error waiting for the direct conversation merge lock:", err)
+		return
+	}
+	defer migrations.DeleteOne(context.Background(), bson.M{"_id": mergeLock, "owner": owner})
+	conversations := client.Database("Chat_App").Collection("conversations")
+	messages := client.Database("Chat_App").Collection("messages")
+	cursor, err := conversations.Find(ctx,
+		bson.M{"is_group": bson.M{"$ne": true}, "direct_key": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		log.Println("Error loading direct conversations:", err)
+		return
+	}
+	var unkeyed []models.Conversation
+	if err := cursor.All(ctx, &unkeyed); err != nil {
+		log.Println("Error decoding direct conversations:", err)
+		return
+	}
+	pairs := make(map[string][]models.Conversation)
+	var keys []string
+	for _, conversation := range unkeyed {
+		if len(conversation.Participants) != 2 {
+			log.Println("Skipping direct conversation without two participants:", conversation.RoomId)
+			continue
+		}
+		key := models.DirectKey(conversation.Participants[0].Id, conversation.Participants[1].Id)
+		if pairs[key] == nil {
+			keys = append(keys, key)
+		}
+		pairs[key] = append(pairs[key], conversation)
+	}
+	merged := 0
+	for _, key := range keys {
+		group := pairs[key]
+		// A conversation keyed by an earlier run wins over the unkeyed ones.
+		var keyed models.Conversation
+		if err := conversations.FindOne(ctx, bson.M{"direct_key": key}).Decode(&keyed); err == nil {
+			group = append([]models.Conversation{keyed}, group...)
+		}
+		if err := mergeDirect(ctx, conversations, messages, key, group); err != nil {
+			log.Println("Error merging direct conversations for", key+":", err)
+			continue
+		}
+		merged += len(group) - 1
+	}
+	if len(keys) > 0 {
+		log.Println("Keyed", len(keys), "direct conversations, merged", merged, "duplicates")
+	}
+}
+
+// acquireLock waits until it holds the named lock. A lock expires after ten
+// minutes, so an instance that died holding it does not block the rest.
+func acquireLock(ctx context.Context, migrations *mongo.Collection, name string, owner string) error {
+	for {
+		now := time.Now()
+		_, err := migrations.UpdateOne(ctx,
+			bson.M{"_id": name, "locked_until": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "locked_until": now.Add(10 * time.Minute)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// Another instance holds it; once it is done there is little left
+		// for this one to merge.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// mergeDirect keeps the first conversation of group and moves everything
+// from the rest into it.
+func mergeDirect(ctx context.Context, conversations, messages *mongo.Collection, key string, group []models.Conversation) error {
+	keep := group[0]
+	var duplicates []string
+	var duplicateIds []interface{}
+	for _, conversation := range group[1:] {
+		duplicates = append(duplicates, conversation.RoomId)
+		duplicateIds = append(duplicateIds, conversation.Id)
+	}
+	if len(duplicates) > 0 {
+		if err := clearClientIdClashes(ctx, messages, append([]string{keep.RoomId}, duplicates...)); err != nil {
+			return err
+		}
+		_, err := messages.UpdateMany(ctx,
+			bson.M{"room_id": bson.M{"$in": duplicates}},
+			bson.M{"$set": bson.M{"room_id": keep.RoomId}})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Each participant keeps the furthest read and delivery markers and the
+	// earliest join time across the duplicates.
+	participants := make(map[string]*models.Participant)
+	for i := range keep.Participants {
+		participants[keep.Participants[i].Id] = &keep.Participants[i]
+	}
+	updatedAt := keep.UpdatedAt
+	for _, conversation := range group[1:] {
+		if conversation.UpdatedAt.After(updatedAt) {
+			updatedAt = conversation.UpdatedAt
+		}
+		for _, other := range conversation.Participants {
+			p := participants[other.Id]
+			if p == nil {
+				continue
+			}
+			if p.JoinedAt.IsZero() || !other.JoinedAt.IsZero() && other.JoinedAt.Before(p.JoinedAt) {
+				p.JoinedAt = other.JoinedAt
+			}
+			if other.LastReadAt.After(p.LastReadAt) {
+				p.LastReadAt = other.LastReadAt
+				p.LastReadMessageId = other.LastReadMessageId
+			}
+			if other.LastDeliveredAt.After(p.LastDeliveredAt) {
+				p.LastDeliveredAt = other.LastDeliveredAt
+				p.LastDeliveredMessageId = other.LastDeliveredMessageId
+			}
+		}
+	}
+
+	set := bson.M{"direct_key": key, "participants": keep.Participants, "updated_at": updatedAt}
+	var last models.Message
+	err := messages.FindOne(ctx,
+		bson.M{"room_id": keep.RoomId, "thread_id": bson.M{"$exists": false}},
+		options.FindOne().
+			SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+			SetProjection(bson.M{"edit_history": 0})).Decode(&last)
+	if err == nil {
+		set["last_message"] = last
+		if last.CreatedAt.After(updatedAt) {
+			set["updated_at"] = last.CreatedAt
+		}
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+	// Remove the duplicates first so the key is free for the one we keep.
+	if len(duplicateIds) > 0 {
+		if _, err := conversations.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicateIds}}); err != nil {
+			return err
+		}
+	}
+	_, err = conversations.UpdateOne(ctx, bson.M{"_id": keep.Id}, bson.M{"$set": set})
+	return err
+}
+
+// clearClientIdClashes finds messages in rooms that would share a client_id
+// from the same sender once the rooms are one, and clears it on all but the
+// newest, which the sender's retries would be matched against.
+func clearClientIdClashes(ctx context.Context, messages *mongo.Collection, roomIds []string) error {
+	cursor, err := messages.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"room_id": bson.M{"$in": roomIds}, "client_id": bson.M{"$type": "string"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"user_id": "$user_id", "client_id": "$client_id"},
+			"ids": bson.M{"$push": "$_id"},
+		}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var clashes []struct {
+		Ids []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &clashes); err != nil {
+		return err
+	}
+	var older []primitive.ObjectID
+	for _, clash := range clashes {
+		older = append(older, clash.Ids[1:]...)
+	}
+	if len(older) == 0 {
+		return nil
+	}
+	_, err = messages.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": older}},
+		bson.M{"$unset": bson.M{"client_id": ""}})
+	return err
+}
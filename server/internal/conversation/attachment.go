@@ -0,0 +1,182 @@
+package conversation
+
+import (
+	"chat-server/internal/message"
+	"chat-server/models"
+	"chat-server/services"
+	"chat-server/tokens"
+	"context"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultAttachmentSize is the upload limit when ATTACHMENT_MAX_BYTES is
+// not set.
+const defaultAttachmentSize = 25 << 20
+
+// attachmentTypes are the content types accepted for attachments, as
+// detected from the file itself rather than what the client claims.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":       true,
+	"image/png":        true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"application/pdf":  true,
+	"application/zip":  true,
+	"text/plain":       true,
+	"audio/mpeg":       true,
+	"audio/wave":       true,
+	"audio/ogg":        true,
+	"video/mp4":        true,
+	"video/webm":       true,
+	"application/ogg":  true,
+	"application/json": true,
+}
+
+func maxAttachmentSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultAttachmentSize
+}
+
+// UploadAttachment stores a file sent as the multipart field "file" for use
+// in the given room. The returned attachment's _id goes in the
+// attachment_ids of the message that shares it.
+func UploadAttachment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		limit := maxAttachmentSize()
+		// Leave room for the multipart headers around the file.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1<<20)
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large", "max_bytes": limit})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+			return
+		}
+		defer file.Close()
+		if header.Size > limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large", "max_bytes": limit})
+			return
+		}
+		contentType, err := services.SniffType(file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file", "message": err.Error()})
+			return
+		}
+		if !attachmentTypes[contentType] {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Files of type " + contentType + " cannot be attached"})
+			return
+		}
+
+		attachment := &models.Attachment{
+			Id:         primitive.NewObjectID(),
+			RoomId:     conversation.RoomId,
+			UploadedBy: user_id,
+			Name:       path.Base(strings.ReplaceAll(header.Filename, "\\", "/")),
+			Size:       header.Size,
+			Type:       contentType,
+			CreatedAt:  time.Now(),
+		}
+		if strings.HasPrefix(contentType, "image/") {
+			if config, _, err := image.DecodeConfig(file); err == nil {
+				attachment.Width = config.Width
+				attachment.Height = config.Height
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file", "message": err.Error()})
+				return
+			}
+		}
+		storage, err := services.DefaultStorage()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage is unavailable", "message": err.Error()})
+			return
+		}
+		key := "attachments/" + conversation.RoomId + "/" + attachment.Id.Hex() + "/" + attachment.Name
+		attachment.URL, err = storage.Put(ctx, key, file, contentType)
+		if err != nil {
+			log.Println("Error uploading attachment:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file", "message": err.Error()})
+			return
+		}
+		attachment.Key = key
+		if err := message.SaveAttachment(ctx, attachment); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment", "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "data": attachment})
+	}
+}
+
+// AuthorizeFile guards downloads under attachments/<room_id>/ so only
+// members of the room can fetch them, and nobody once the message they were
+// sent with is deleted. The token is read from the
+// Authorization header or, for links opened by the browser, the "token"
+// query parameter. Other files, such as profile images, stay public. This
+// holds for every backend, S3 included, as all files are read through
+// /files.
+func AuthorizeFile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.SplitN(services.CleanKey(c.Param("key")), "/", 3)
+		if parts[0] != "attachments" {
+			c.Next()
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			token = c.Query("token")
+		}
+		claims, err := tokens.ValidateToken(token)
+		if token == "" || err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "message": "A token is required for attachments"})
+			return
+		}
+		if len(parts) < 3 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conversation, err := getConversationByRoomId(ctx, parts[1])
+		if err != nil || conversation.Participant(claims.UserId) == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		deleted, err := message.AttachmentDeleted(ctx, strings.Join(parts, "/"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file", "message": err.Error()})
+			return
+		}
+		if deleted {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		c.Next()
+	}
+}
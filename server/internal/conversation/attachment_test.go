@@ -0,0 +1,182 @@
+package conversation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"chat-server/db/dbtest"
+	"chat-server/internal/message"
+	"chat-server/models"
+	"chat-server/tokens"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func pngBytes(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMaxAttachmentSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"":       defaultAttachmentSize,
+		"1024":   1024,
+		"0":      defaultAttachmentSize,
+		"-5":     defaultAttachmentSize,
+		"lots":   defaultAttachmentSize,
+		"999999": 999999,
+	} {
+		t.Setenv("ATTACHMENT_MAX_BYTES", value)
+		if got := maxAttachmentSize(); got != want {
+			t.Errorf("ATTACHMENT_MAX_BYTES=%q: got %d, want %d", value, got, want)
+		}
+	}
+}
+
+// useTestDatabase points the collections UploadAttachment uses at a scratch
+// database, and skips the test without one.
+func useTestDatabase(t *testing.T) {
+	dbtest.Use(t, dbtest.Database(t), map[string]**mongo.Collection{
+		"conversations": &ConversationCollection,
+		"attachments":   &message.AttachmentCollection,
+	})
+}
+
+func postFile(userId string, roomId string, name string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", name)
+	part.Write(data)
+	form.Close()
+	router := gin.New()
+	router.POST("/rooms/:room_id/attachments", func(c *gin.Context) {
+		c.Set("user_id", userId)
+	}, UploadAttachment())
+	request := httptest.NewRequest(http.MethodPost, "/rooms/"+roomId+"/attachments", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestUploadAttachment(t *testing.T) {
+	useTestDatabase(t)
+	t.Setenv("STORAGE_BACKEND", "memory")
+	t.Setenv("ATTACHMENT_MAX_BYTES", "4096")
+	gin.SetMode(gin.TestMode)
+	_, err := ConversationCollection.InsertOne(context.Background(), models.Conversation{
+		Id:           primitive.NewObjectID(),
+		RoomId:       "r1",
+		Participants: []models.Participant{{Id: "u1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := postFile("u2", "r1", "a.txt", []byte("hi")).Code; code != http.StatusForbidden {
+		t.Errorf("non-member: got %d, want 403", code)
+	}
+	if code := postFile("u1", "r1", "big.txt", []byte(strings.Repeat("x", 5000))).Code; code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized file: got %d, want 413", code)
+	}
+	if code := postFile("u1", "r1", "page.png", []byte("<html><script>alert(1)</script></html>")).Code; code != http.StatusUnsupportedMediaType {
+		t.Errorf("html named .png: got %d, want 415", code)
+	}
+
+	recorder := postFile("u1", "r1", "../../pic.png", pngBytes(t, 3, 2))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("png: got %d: %s", recorder.Code, recorder.Body)
+	}
+	var response struct {
+		Data models.Attachment `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	got := response.Data
+	if got.Name != "pic.png" || got.Type != "image/png" || got.Width != 3 || got.Height != 2 || got.URL == "" {
+		t.Errorf("got %+v", got)
+	}
+	if _, err := message.Attachments(context.Background(), "r1", "u1", []string{got.Id.Hex()}); err != nil {
+		t.Errorf("uploaded attachment cannot be sent: %v", err)
+	}
+}
+
+func TestAuthorizeFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/files/*key", AuthorizeFile(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	for path, want := range map[string]int{
+		"/files/avatar":                              http.StatusOK,
+		"/files/attachments/r1/a/x.pdf":              http.StatusUnauthorized,
+		"/files/./attachments/r1/a/x.pdf":            http.StatusUnauthorized,
+		"/files/attachments/r1/a/x.pdf?token=":       http.StatusUnauthorized,
+		"/files/attachments/r1/a/x.pdf?token=forged": http.StatusUnauthorized,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != want {
+			t.Errorf("%s: got %d, want %d", path, recorder.Code, want)
+		}
+	}
+}
+
+func TestAuthorizeDeletedFile(t *testing.T) {
+	useTestDatabase(t)
+	secret := tokens.SECRET_KEY
+	tokens.SECRET_KEY = "test"
+	t.Cleanup(func() { tokens.SECRET_KEY = secret })
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	_, err := ConversationCollection.InsertOne(ctx, models.Conversation{
+		Id:           primitive.NewObjectID(),
+		RoomId:       "r1",
+		Participants: []models.Participant{{Id: "u1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"attachments/r1/a/kept.txt", "attachments/r1/b/gone.txt"} {
+		if err := message.SaveAttachment(ctx, &models.Attachment{Id: primitive.NewObjectID(), RoomId: "r1", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = message.AttachmentCollection.UpdateOne(ctx,
+		bson.M{"key": "attachments/r1/b/gone.txt"},
+		bson.M{"$set": bson.M{"deleted": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.GenerateToken("u1@example.com", "u1", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/files/*key", AuthorizeFile(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	for path, want := range map[string]int{
+		"/files/attachments/r1/a/kept.txt": http.StatusOK,
+		"/files/attachments/r1/b/gone.txt": http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"?token="+token, nil))
+		if recorder.Code != want {
+			t.Errorf("%s: got %d, want %d", path, recorder.Code, want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package conversation
 
 import (
 	"chat-server/db"
+	"chat-server/internal/message"
 	user "chat-server/internal/users"
+	"chat-server/internal/ws"
 	"chat-server/models"
 	"context"
 	"log"
@@ -18,6 +20,26 @@ import (
 var ConversationCollection = db.ConversationData(db.Client, "conversations")
 var MessageCollection = db.MessageData(db.Client, "messages")
 
+func getConversationByRoomId(ctx context.Context, roomId string) (*models.Conversation, error) {
+	var conversation models.Conversation
+	err := ConversationCollection.FindOne(ctx, bson.M{"room_id": roomId}).Decode(&conversation)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func findDirect(ctx context.Context, directKey string) (*models.Conversation, error) {
+	var conversation models.Conversation
+	err := ConversationCollection.FindOne(ctx, bson.M{"direct_key": directKey}).Decode(&conversation)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// AddUserToConversation opens a direct conversation with another user, or
+// returns the room_id of the one they already share.
 func AddUserToConversation() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log.Println("Participants: xndxndcindcek")
@@ -61,21 +83,32 @@ func AddUserToConversation() gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"message": "User is not verified"})
 			return
 		}
+		directKey := models.DirectKey(user_id.(string), second_user_id)
+		if existing, err := findDirect(ctx, directKey); err == nil {
+			c.JSON(http.StatusOK, gin.H{"message": "Conversation already exists", "room_id": existing.RoomId})
+			return
+		}
 		var conversation models.Conversation
 		conversation.Id = primitive.NewObjectID()
 		conversation.RoomId = conversation.Id.Hex()
+		conversation.DirectKey = directKey
+		conversation.CreatedBy = user_id.(string)
 		conversation.Participants = []models.Participant{
 			{
 				Id:       user_id.(string),
 				Username: username.(string),
 				Email:    email.(string),
 				Image:    currentUser.Image,
+				Role:     models.RoleMember,
+				JoinedAt: time.Now(),
 			},
 			{
 				Id:       second_user_id,
 				Username: secondUser.Username,
 				Email:    secondUser.Email,
 				Image:    secondUser.Image,
+				Role:     models.RoleMember,
+				JoinedAt: time.Now(),
 			},
 		}
 
@@ -83,11 +116,18 @@ func AddUserToConversation() gin.HandlerFunc {
 		conversation.CreatedAt = time.Now()
 		conversation.UpdatedAt = time.Now()
 		_, err = ConversationCollection.InsertOne(ctx, conversation)
+		if mongo.IsDuplicateKeyError(err) {
+			// The other user created it at the same moment.
+			if existing, err := findDirect(ctx, directKey); err == nil {
+				c.JSON(http.StatusOK, gin.H{"message": "Conversation already exists", "room_id": existing.RoomId})
+				return
+			}
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation", "message": "Please try again later"})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": "User added successfully"})
+		c.JSON(http.StatusOK, gin.H{"message": "User added successfully", "room_id": conversation.RoomId})
 
 	}
 }
@@ -106,6 +146,39 @@ func GetConversationByUserId() gin.HandlerFunc {
 		var conversations []models.Conversation
 		pipeline := mongo.Pipeline{
 			{{Key: "$match", Value: bson.D{{Key: "participants.id", Value: user_id}}}},
+			{{Key: "$addFields", Value: bson.D{{Key: "me", Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{
+				bson.D{{Key: "$filter", Value: bson.D{
+					{Key: "input", Value: "$participants"},
+					{Key: "as", Value: "p"},
+					{Key: "cond", Value: bson.D{{Key: "$eq", Value: bson.A{"$$p.id", user_id}}}},
+				}}},
+				0,
+			}}}}}}},
+			{{Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: "messages"},
+				{Key: "let", Value: bson.D{
+					{Key: "room", Value: "$room_id"},
+					{Key: "since", Value: bson.D{{Key: "$max", Value: bson.A{
+						bson.D{{Key: "$ifNull", Value: bson.A{"$me.last_read_at", time.Time{}}}},
+						bson.D{{Key: "$ifNull", Value: bson.A{"$me.joined_at", time.Time{}}}},
+					}}}},
+				}},
+				{Key: "pipeline", Value: mongo.Pipeline{
+					{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{
+						bson.D{{Key: "$eq", Value: bson.A{"$room_id", "$$room"}}},
+						bson.D{{Key: "$gt", Value: bson.A{"$created_at", "$$since"}}},
+						bson.D{{Key: "$ne", Value: bson.A{"$user_id", user_id}}},
+						bson.D{{Key: "$ne", Value: bson.A{"$deleted", true}}},
+						bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$thread_id"}}, "missing"}}},
+					}}}}}}},
+					{{Key: "$count", Value: "n"}},
+				}},
+				{Key: "as", Value: "unread"},
+			}}},
+			{{Key: "$addFields", Value: bson.D{{Key: "unread_count", Value: bson.D{{Key: "$ifNull", Value: bson.A{
+				bson.D{{Key: "$arrayElemAt", Value: bson.A{"$unread.n", 0}}},
+				0,
+			}}}}}}},
 			{{Key: "$unwind", Value: "$participants"}},
 			{{Key: "$lookup", Value: bson.D{
 				{Key: "from", Value: "users"},
@@ -116,12 +189,28 @@ func GetConversationByUserId() gin.HandlerFunc {
 			{{Key: "$unwind", Value: "$userInfo"}},
 			{{Key: "$group", Value: bson.D{
 				{Key: "_id", Value: "$_id"},
+				{Key: "room_id", Value: bson.D{{Key: "$first", Value: "$room_id"}}},
+				{Key: "is_group", Value: bson.D{{Key: "$first", Value: "$is_group"}}},
+				{Key: "name", Value: bson.D{{Key: "$first", Value: "$name"}}},
+				{Key: "image", Value: bson.D{{Key: "$first", Value: "$image"}}},
+				{Key: "created_by", Value: bson.D{{Key: "$first", Value: "$created_by"}}},
+				{Key: "created_at", Value: bson.D{{Key: "$first", Value: "$created_at"}}},
+				{Key: "updated_at", Value: bson.D{{Key: "$first", Value: "$updated_at"}}},
+				{Key: "last_message", Value: bson.D{{Key: "$first", Value: "$last_message"}}},
+				{Key: "unread_count", Value: bson.D{{Key: "$first", Value: "$unread_count"}}},
 				{Key: "participants", Value: bson.D{{Key: "$push", Value: bson.D{
 					{Key: "id", Value: "$participants.id"},
 					{Key: "username", Value: "$participants.username"},
 					{Key: "image", Value: "$userInfo.image"},
+					{Key: "role", Value: "$participants.role"},
+					{Key: "joined_at", Value: "$participants.joined_at"},
+					{Key: "last_read_message_id", Value: "$participants.last_read_message_id"},
+					{Key: "last_read_at", Value: "$participants.last_read_at"},
+					{Key: "last_delivered_message_id", Value: "$participants.last_delivered_message_id"},
+					{Key: "last_delivered_at", Value: "$participants.last_delivered_at"},
 				}}}},
 			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}}},
 		}
 		cursor, err := ConversationCollection.Aggregate(ctx, pipeline)
 		if err != nil {
@@ -145,22 +234,209 @@ func GetRoomMessages() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		roomId := c.Param("room_id")
-		var messages []models.Message
-		cursor, err := MessageCollection.Find(ctx, bson.M{"room_id": roomId})
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		// Thread replies are fetched with GetThreadMessages.
+		filter := bson.M{"room_id": conversation.RoomId, "thread_id": bson.M{"$exists": false}}
+		page, err := message.FindPage(ctx, filter, message.PageQuery{
+			Before: c.Query("before"),
+			After:  c.Query("after"),
+			Around: c.Query("around"),
+			Limit:  message.ParseLimit(c.Query("limit")),
+		})
+		if err == message.ErrInvalidCursor {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages", "message": err.Error()})
 			return
 		}
-		defer cursor.Close(ctx)
-		err = cursor.All(ctx, &messages)
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Messages fetched successfully",
+			"data":        page.Messages,
+			"has_older":   page.HasOlder,
+			"has_newer":   page.HasNewer,
+			"next_cursor": page.NextCursor,
+			"prev_cursor": page.PrevCursor,
+		})
+	}
+}
+
+// GetThreadMessages pages through the replies in a thread the same way
+// GetRoomMessages pages through the room, and includes the thread root.
+func GetThreadMessages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		root, err := message.ThreadRoot(ctx, conversation.RoomId, c.Param("message_id"))
+		if err != nil {
+			c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		filter := bson.M{"room_id": conversation.RoomId, "thread_id": root.Id.Hex()}
+		page, err := message.FindPage(ctx, filter, message.PageQuery{
+			Before: c.Query("before"),
+			After:  c.Query("after"),
+			Around: c.Query("around"),
+			Limit:  message.ParseLimit(c.Query("limit")),
+		})
+		if err == message.ErrInvalidCursor {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch thread", "message": err.Error()})
+			return
+		}
+		root.EditHistory = nil
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Thread fetched successfully",
+			"root":        root,
+			"data":        page.Messages,
+			"has_older":   page.HasOlder,
+			"has_newer":   page.HasNewer,
+			"next_cursor": page.NextCursor,
+			"prev_cursor": page.PrevCursor,
+		})
+	}
+}
+
+// roomMember loads the conversation named by the room_id path parameter and
+// makes sure the caller belongs to it, writing the error response if not.
+func roomMember(c *gin.Context, ctx context.Context) (*models.Conversation, bool) {
+	conversation, err := getConversationByRoomId(ctx, c.Param("room_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return nil, false
+	}
+	if conversation.Participant(c.GetString("user_id")) == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this conversation"})
+		return nil, false
+	}
+	return conversation, true
+}
+
+func EditMessage(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		var req models.EditMessageReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+			return
+		}
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		edited, err := message.Edit(ctx, conversation, c.Param("message_id"), user_id, req.Content)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode messages", "message": err.Error()})
+			c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		hub.BroadcastEvent(conversation.RoomId, user_id, ws.EventEdit, &ws.EditPayload{
+			RoomId:    edited.RoomId,
+			MessageId: edited.Id.Hex(),
+			Content:   edited.Content,
+			EditedAt:  edited.EditedAt,
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Message edited successfully", "data": edited})
+	}
+}
+
+// ReactToMessage adds the caller's reaction on PUT and removes it on DELETE.
+// Either can be repeated without changing the result.
+func ReactToMessage(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		emoji := c.Param("emoji")
+		reacted := c.Request.Method != http.MethodDelete
+		reactions, changed, err := message.React(ctx, conversation.RoomId, c.Param("message_id"), user_id, emoji, reacted)
+		if err != nil {
+			c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if changed {
+			hub.BroadcastEvent(conversation.RoomId, user_id, ws.EventReaction, &ws.ReactionPayload{
+				RoomId:    conversation.RoomId,
+				MessageId: c.Param("message_id"),
+				UserId:    user_id,
+				Emoji:     emoji,
+				Reacted:   reacted,
+				Reactions: reactions,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Reaction updated successfully", "data": reactions})
+	}
+}
+
+func GetMessageHistory() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		found, err := message.History(ctx, conversation, c.Param("message_id"))
+		if err != nil {
+			c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
-			"message": "Messages fetched successfully",
-			"data":    messages,
+			"message": "Message history fetched successfully",
+			"data":    found,
+		})
+	}
+}
+
+func DeleteMessage(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		conversation, ok := roomMember(c, ctx)
+		if !ok {
+			return
+		}
+		deleted, err := message.Delete(ctx, conversation, c.Param("message_id"), user_id)
+		if err != nil {
+			c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		hub.BroadcastEvent(conversation.RoomId, user_id, ws.EventDelete, &ws.DeletePayload{
+			RoomId:    deleted.RoomId,
+			MessageId: deleted.Id.Hex(),
+			DeletedBy: deleted.DeletedBy,
 		})
+		c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully", "data": deleted})
+	}
+}
+
+func messageErrorStatus(err error) int {
+	switch err {
+	case message.ErrInvalidId, message.ErrNotARoot, message.ErrInvalidEmoji, message.ErrInvalidAttachment:
+		return http.StatusBadRequest
+	case message.ErrNotFound:
+		return http.StatusNotFound
+	case message.ErrForbidden:
+		return http.StatusForbidden
+	case message.ErrNotEditable:
+		return http.StatusConflict
 	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,422 @@
+package conversation
+
+import (
+	"chat-server/internal/message"
+	user "chat-server/internal/users"
+	"chat-server/internal/ws"
+	"chat-server/models"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func findVerifiedParticipants(ctx context.Context, userIds []string) ([]models.Participant, error) {
+	cursor, err := user.UserCollection.Find(ctx, bson.M{"user_id": bson.M{"$in": userIds}, "verified": true})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	participants := make([]models.Participant, 0, len(users))
+	for _, u := range users {
+		participants = append(participants, models.Participant{
+			Id:       u.UserId,
+			Username: u.Username,
+			Email:    u.Email,
+			Image:    u.Image,
+			Role:     models.RoleMember,
+			JoinedAt: time.Now(),
+		})
+	}
+	return participants, nil
+}
+
+func findGroup(ctx context.Context, roomId string, userId string) (*models.Conversation, int, error) {
+	var conversation models.Conversation
+	err := ConversationCollection.FindOne(ctx, bson.M{"room_id": roomId, "is_group": true}).Decode(&conversation)
+	if err != nil {
+		return nil, http.StatusNotFound, fmt.Errorf("group not found")
+	}
+	if conversation.Participant(userId) == nil {
+		return nil, http.StatusForbidden, fmt.Errorf("you are not a member of this group")
+	}
+	return &conversation, http.StatusOK, nil
+}
+
+// announceMembership stores a system message describing a membership change
+// and broadcasts it to the room. A removed participant is kept in the hub's
+// member list until the message has been sent so they see it too.
+func announceMembership(ctx context.Context, hub *ws.Hub, conversation *models.Conversation, removed *models.Participant, actorId, actorName, content string) {
+	msg := &models.Message{
+		Id:        primitive.NewObjectID(),
+		RoomId:    conversation.RoomId,
+		Type:      models.MessageTypeSystem,
+		Username:  actorName,
+		Content:   content,
+		UserId:    actorId,
+		CreatedAt: time.Now(),
+	}
+	if err := message.Insert(ctx, msg); err != nil {
+		log.Println("Error inserting system message:", err)
+		return
+	}
+	members := conversation.Participants
+	if removed != nil {
+		members = append(append([]models.Participant{}, members...), *removed)
+	}
+	hub.Membership <- &ws.MembershipUpdate{RoomId: conversation.RoomId, Members: members}
+	hub.BroadcastMessage(msg)
+	if removed != nil {
+		hub.Membership <- &ws.MembershipUpdate{RoomId: conversation.RoomId, Members: conversation.Participants}
+	}
+}
+
+func CreateGroup(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		var req models.CreateGroupReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+			return
+		}
+		memberIds := []string{user_id}
+		for _, id := range req.MemberIds {
+			if id != user_id {
+				memberIds = append(memberIds, id)
+			}
+		}
+		participants, err := findVerifiedParticipants(ctx, memberIds)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members", "message": err.Error()})
+			return
+		}
+		if len(participants) < 2 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A group needs at least one other verified member"})
+			return
+		}
+		for i := range participants {
+			if participants[i].Id == user_id {
+				participants[i].Role = models.RoleOwner
+			}
+		}
+		var conversation models.Conversation
+		conversation.Id = primitive.NewObjectID()
+		conversation.RoomId = conversation.Id.Hex()
+		conversation.IsGroup = true
+		conversation.Name = req.Name
+		conversation.Image = req.Image
+		conversation.CreatedBy = user_id
+		conversation.Participants = participants
+		conversation.LastMessage = nil
+		conversation.CreatedAt = time.Now()
+		conversation.UpdatedAt = time.Now()
+		_, err = ConversationCollection.InsertOne(ctx, conversation)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group", "message": "Please try again later"})
+			return
+		}
+		announceMembership(ctx, hub, &conversation, nil, user_id, username, fmt.Sprintf("%s created the group %q", username, req.Name))
+		c.JSON(http.StatusCreated, gin.H{"message": "Group created successfully", "data": conversation})
+	}
+}
+
+func AddGroupMembers(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		var req models.AddMembersReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+			return
+		}
+		conversation, status, err := findGroup(ctx, c.Param("room_id"), user_id)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		var newIds []string
+		for _, id := range req.UserIds {
+			if conversation.Participant(id) == nil {
+				newIds = append(newIds, id)
+			}
+		}
+		if len(newIds) == 0 {
+			c.JSON(http.StatusOK, gin.H{"message": "No new members to add", "data": conversation})
+			return
+		}
+		added, err := findVerifiedParticipants(ctx, newIds)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members", "message": err.Error()})
+			return
+		}
+		if len(added) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No verified users found"})
+			return
+		}
+		_, err = ConversationCollection.UpdateOne(ctx,
+			bson.M{"room_id": conversation.RoomId},
+			bson.M{
+				"$push": bson.M{"participants": bson.M{"$each": added}},
+				"$set":  bson.M{"updated_at": time.Now()},
+			})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add members", "message": err.Error()})
+			return
+		}
+		conversation.Participants = append(conversation.Participants, added...)
+		for _, p := range added {
+			announceMembership(ctx, hub, conversation, nil, user_id, username, fmt.Sprintf("%s added %s", username, p.Username))
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Members added successfully", "data": conversation})
+	}
+}
+
+func RemoveGroupMember(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		memberId := c.Param("user_id")
+		conversation, status, err := findGroup(ctx, c.Param("room_id"), user_id)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		if memberId == user_id {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Use the leave endpoint to leave a group"})
+			return
+		}
+		caller := conversation.Participant(user_id)
+		target := conversation.Participant(memberId)
+		if target == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+			return
+		}
+		if !conversation.IsAdmin(user_id) || models.RoleRank(caller.Role) <= models.RoleRank(target.Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to remove this member"})
+			return
+		}
+		removed, _ := removeParticipant(conversation, memberId)
+		_, err = ConversationCollection.UpdateOne(ctx,
+			bson.M{"room_id": conversation.RoomId},
+			bson.M{
+				"$pull": bson.M{"participants": bson.M{"id": memberId}},
+				"$set":  bson.M{"updated_at": time.Now()},
+			})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member", "message": err.Error()})
+			return
+		}
+		announceMembership(ctx, hub, conversation, &removed, user_id, username, fmt.Sprintf("%s removed %s", username, removed.Username))
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully", "data": conversation})
+	}
+}
+
+func LeaveGroup(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		conversation, status, err := findGroup(ctx, c.Param("room_id"), user_id)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		wasOwner := conversation.Participant(user_id).Role == models.RoleOwner
+		leaving, _ := removeParticipant(conversation, user_id)
+		var successor *models.Participant
+		if wasOwner && len(conversation.Participants) > 0 {
+			successor = nextOwner(conversation)
+			successor.Role = models.RoleOwner
+		}
+		_, err = ConversationCollection.UpdateOne(ctx,
+			bson.M{"room_id": conversation.RoomId},
+			bson.M{
+				"$pull": bson.M{"participants": bson.M{"id": user_id}},
+				"$set":  bson.M{"updated_at": time.Now()},
+			})
+		if err == nil && successor != nil {
+			err = setRoles(ctx, conversation.RoomId, successor)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave group", "message": err.Error()})
+			return
+		}
+		announceMembership(ctx, hub, conversation, &leaving, user_id, username, fmt.Sprintf("%s left the group", username))
+		if successor != nil {
+			announceRoleChange(ctx, hub, conversation, successor, user_id, username)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Left group successfully"})
+	}
+}
+
+func removeParticipant(conversation *models.Conversation, userId string) (models.Participant, bool) {
+	for i, p := range conversation.Participants {
+		if p.Id == userId {
+			conversation.Participants = append(conversation.Participants[:i], conversation.Participants[i+1:]...)
+			return p, true
+		}
+	}
+	return models.Participant{}, false
+}
+
+// setRoles stores the roles of the given participants, touching nothing
+// else in the participants array so concurrent joins and read markers are
+// kept.
+func setRoles(ctx context.Context, roomId string, participants ...*models.Participant) error {
+	set := bson.M{"updated_at": time.Now()}
+	var filters []interface{}
+	for i, p := range participants {
+		name := fmt.Sprintf("p%d", i)
+		set["participants.$["+name+"].role"] = p.Role
+		filters = append(filters, bson.M{name + ".id": p.Id})
+	}
+	_, err := ConversationCollection.UpdateOne(ctx,
+		bson.M{"room_id": roomId},
+		bson.M{"$set": set},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: filters}))
+	return err
+}
+
+// nextOwner picks who inherits a group when its owner leaves: the admin who
+// joined first, or the longest-standing member if there are no admins.
+func nextOwner(conversation *models.Conversation) *models.Participant {
+	var next *models.Participant
+	for i := range conversation.Participants {
+		p := conversation.Participant(conversation.Participants[i].Id)
+		if next == nil ||
+			models.RoleRank(p.Role) > models.RoleRank(next.Role) ||
+			(p.Role == next.Role && p.JoinedAt.Before(next.JoinedAt)) {
+			next = p
+		}
+	}
+	return next
+}
+
+func announceRoleChange(ctx context.Context, hub *ws.Hub, conversation *models.Conversation, target *models.Participant, actorId, actorName string) {
+	msg := &models.Message{
+		Id:        primitive.NewObjectID(),
+		RoomId:    conversation.RoomId,
+		Type:      models.MessageTypeRoleChange,
+		Username:  actorName,
+		Content:   fmt.Sprintf("%s is now %s", target.Username, target.Role),
+		UserId:    actorId,
+		Meta:      map[string]string{"user_id": target.Id, "role": target.Role},
+		CreatedAt: time.Now(),
+	}
+	if err := message.Insert(ctx, msg); err != nil {
+		log.Println("Error inserting role change message:", err)
+		return
+	}
+	hub.BroadcastMessage(msg)
+}
+
+func UpdateGroup(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		var req models.UpdateGroupReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+			return
+		}
+		conversation, status, err := findGroup(ctx, c.Param("room_id"), user_id)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		if !conversation.IsAdmin(user_id) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can update the group"})
+			return
+		}
+		update := bson.M{"updated_at": time.Now()}
+		if req.Name != "" {
+			update["name"] = req.Name
+			conversation.Name = req.Name
+		}
+		if req.Image != "" {
+			update["image"] = req.Image
+			conversation.Image = req.Image
+		}
+		_, err = ConversationCollection.UpdateOne(ctx, bson.M{"room_id": conversation.RoomId}, bson.M{"$set": update})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group", "message": err.Error()})
+			return
+		}
+		if req.Name != "" {
+			announceMembership(ctx, hub, conversation, nil, user_id, username, fmt.Sprintf("%s renamed the group to %q", username, req.Name))
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Group updated successfully", "data": conversation})
+	}
+}
+
+func UpdateMemberRole(hub *ws.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		username := c.GetString("username")
+		memberId := c.Param("user_id")
+		var req models.UpdateRoleReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+			return
+		}
+		if models.RoleRank(req.Role) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, admin or member"})
+			return
+		}
+		conversation, status, err := findGroup(ctx, c.Param("room_id"), user_id)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		if conversation.Participant(user_id).Role != models.RoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the group owner can change roles"})
+			return
+		}
+		if memberId == user_id {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Transfer ownership to another member instead"})
+			return
+		}
+		target := conversation.Participant(memberId)
+		if target == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+			return
+		}
+		changed := []*models.Participant{target}
+		target.Role = req.Role
+		if req.Role == models.RoleOwner {
+			self := conversation.Participant(user_id)
+			self.Role = models.RoleAdmin
+			changed = append(changed, self)
+		}
+		if err := setRoles(ctx, conversation.RoomId, changed...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role", "message": err.Error()})
+			return
+		}
+		for _, p := range changed {
+			announceRoleChange(ctx, hub, conversation, p, user_id, username)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully", "data": conversation})
+	}
+}
@@ -0,0 +1,108 @@
+package conversation
+
+import (
+	"chat-server/internal/message"
+	"chat-server/models"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSearchLength caps the q parameter of SearchMessages.
+const maxSearchLength = 200
+
+// SearchMessages finds messages matching q in the caller's conversations.
+// room_id, sender_id, from and to (RFC3339) narrow the search; limit and
+// offset page through the results, best match first.
+func SearchMessages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		q := c.Query("q")
+		if q == "" || len(q) > maxSearchLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "q is required and must be at most 200 characters"})
+			return
+		}
+		query := message.SearchQuery{
+			Text:     q,
+			SenderId: c.Query("sender_id"),
+			Limit:    message.ParseLimit(c.Query("limit")),
+		}
+		if raw := c.Query("offset"); raw != "" {
+			offset, err := strconv.Atoi(raw)
+			if err != nil || offset < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+				return
+			}
+			query.Offset = offset
+		}
+		for param, bound := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+			raw := c.Query(param)
+			if raw == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC3339 timestamp"})
+				return
+			}
+			*bound = &t
+		}
+
+		// Only conversations the caller is in are searched.
+		scope := bson.M{"participants.id": user_id}
+		if roomId := c.Query("room_id"); roomId != "" {
+			scope["room_id"] = roomId
+		}
+		cursor, err := ConversationCollection.Find(ctx, scope, options.Find().SetProjection(bson.M{"room_id": 1}))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations", "message": err.Error()})
+			return
+		}
+		var conversations []models.Conversation
+		if err := cursor.All(ctx, &conversations); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode conversations", "message": err.Error()})
+			return
+		}
+		if len(conversations) == 0 && c.Query("room_id") != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this conversation"})
+			return
+		}
+		for _, conversation := range conversations {
+			query.RoomIds = append(query.RoomIds, conversation.RoomId)
+		}
+
+		results := []message.SearchResult{}
+		hasMore := false
+		if len(query.RoomIds) > 0 {
+			results, hasMore, err = message.Search(ctx, query)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages", "message": err.Error()})
+				return
+			}
+		}
+		for i := range results {
+			results[i].Context = messageContext(&results[i].Message)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Messages searched successfully",
+			"data":     results,
+			"has_more": hasMore,
+		})
+	}
+}
+
+// messageContext is the history request that pages around msg: the room
+// timeline, or the thread for a thread reply.
+func messageContext(msg *models.Message) string {
+	if msg.ThreadId != "" {
+		return "/rooms/" + msg.RoomId + "/messages/" + msg.ThreadId + "/thread?around=" + msg.Id.Hex()
+	}
+	return "/get_room_messages/" + msg.RoomId + "?around=" + msg.Id.Hex()
+}
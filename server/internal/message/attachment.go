@@ -0,0 +1,123 @@
+package message
+
+import (
+	"chat-server/db"
+	"chat-server/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var AttachmentCollection = db.MessageData(db.Client, "attachments")
+
+// maxAttachments caps how many files one message can carry.
+const maxAttachments = 10
+
+var ErrInvalidAttachment = errors.New("attachments must be your own unused uploads to this room")
+
+// SaveAttachment records an uploaded file so it can be attached to a
+// message in the same room.
+func SaveAttachment(ctx context.Context, attachment *models.Attachment) error {
+	_, err := AttachmentCollection.InsertOne(ctx, attachment)
+	return err
+}
+
+// Attachments loads the uploads named by ids. Each one must have been
+// uploaded to the room by the user and not be attached to a message yet.
+func Attachments(ctx context.Context, roomId string, userId string, ids []string) ([]models.Attachment, error) {
+	if len(ids) > maxAttachments {
+		return nil, ErrInvalidAttachment
+	}
+	objectIds := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, ErrInvalidAttachment
+		}
+		objectIds = append(objectIds, objectId)
+	}
+	cursor, err := AttachmentCollection.Find(ctx, bson.M{
+		"_id":         bson.M{"$in": objectIds},
+		"room_id":     roomId,
+		"uploaded_by": userId,
+		"message_id":  bson.M{"$exists": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var found []models.Attachment
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	if len(found) != len(objectIds) {
+		return nil, ErrInvalidAttachment
+	}
+	// Keep the order the sender listed them in.
+	byId := make(map[primitive.ObjectID]models.Attachment, len(found))
+	for _, attachment := range found {
+		byId[attachment.Id] = attachment
+	}
+	attachments := make([]models.Attachment, 0, len(objectIds))
+	for _, id := range objectIds {
+		attachments = append(attachments, byId[id])
+	}
+	return attachments, nil
+}
+
+// removeAttachments marks the uploads of a deleted message so their files
+// are no longer served.
+func removeAttachments(ctx context.Context, message *models.Message) error {
+	_, err := AttachmentCollection.UpdateMany(ctx,
+		bson.M{"message_id": message.Id},
+		bson.M{"$set": bson.M{"deleted": true}})
+	return err
+}
+
+// AttachmentDeleted reports whether the file stored under key was attached
+// to a message that has since been deleted.
+func AttachmentDeleted(ctx context.Context, key string) (bool, error) {
+	err := AttachmentCollection.FindOne(ctx, bson.M{"key": key, "deleted": true}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// claimAttachments marks a message's attachments as used. Uploads already
+// claimed by the same message count, so a retry can claim them again. If
+// another message got to any of them first, the rest are released and
+// ErrInvalidAttachment is returned.
+func claimAttachments(ctx context.Context, message *models.Message) error {
+	if len(message.Attachments) == 0 {
+		return nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(message.Attachments))
+	for _, attachment := range message.Attachments {
+		ids = append(ids, attachment.Id)
+	}
+	result, err := AttachmentCollection.UpdateMany(ctx,
+		bson.M{
+			"_id": bson.M{"$in": ids},
+			"$or": bson.A{
+				bson.M{"message_id": bson.M{"$exists": false}},
+				bson.M{"message_id": message.Id},
+			},
+		},
+		bson.M{"$set": bson.M{"message_id": message.Id}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < int64(len(ids)) {
+		_, err := AttachmentCollection.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": ids}, "message_id": message.Id},
+			bson.M{"$unset": bson.M{"message_id": ""}})
+		if err != nil {
+			return err
+		}
+		return ErrInvalidAttachment
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package message
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chat-server/db/dbtest"
+	"chat-server/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useTestDatabase points the package's collections at a scratch database,
+// and skips the test without one.
+func useTestDatabase(t *testing.T) {
+	dbtest.Use(t, dbtest.Database(t), map[string]**mongo.Collection{
+		"messages":      &MessageCollection,
+		"conversations": &ConversationCollection,
+		"attachments":   &AttachmentCollection,
+	})
+}
+
+func upload(t *testing.T, roomId string, userId string, name string) models.Attachment {
+	t.Helper()
+	attachment := models.Attachment{
+		Id:         primitive.NewObjectID(),
+		RoomId:     roomId,
+		UploadedBy: userId,
+		Name:       name,
+		Size:       3,
+		Type:       "text/plain",
+		URL:        "http://files/" + name,
+		Key:        "attachments/" + roomId + "/" + name,
+		CreatedAt:  time.Now(),
+	}
+	if err := SaveAttachment(context.Background(), &attachment); err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+func TestAttachments(t *testing.T) {
+	useTestDatabase(t)
+	ctx := context.Background()
+	first := upload(t, "r1", "u1", "a.txt")
+	second := upload(t, "r1", "u1", "b.txt")
+	otherUser := upload(t, "r1", "u2", "c.txt")
+	otherRoom := upload(t, "r2", "u1", "d.txt")
+
+	attachments, err := Attachments(ctx, "r1", "u1", []string{second.Id.Hex(), first.Id.Hex()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 || attachments[0].Id != second.Id || attachments[1].Id != first.Id {
+		t.Fatalf("got %+v, want the uploads in the order asked for", attachments)
+	}
+
+	for name, ids := range map[string][]string{
+		"another user's upload": {otherUser.Id.Hex()},
+		"another room's upload": {otherRoom.Id.Hex()},
+		"an unknown upload":     {primitive.NewObjectID().Hex()},
+		"a malformed id":        {"nope"},
+		"too many uploads":      make([]string, maxAttachments+1),
+	} {
+		if _, err := Attachments(ctx, "r1", "u1", ids); err != ErrInvalidAttachment {
+			t.Errorf("%s: got %v, want ErrInvalidAttachment", name, err)
+		}
+	}
+
+	msg := &models.Message{
+		Id:          primitive.NewObjectID(),
+		RoomId:      "r1",
+		UserId:      "u1",
+		Type:        models.MessageTypeText,
+		Attachments: attachments,
+		CreatedAt:   time.Now(),
+	}
+	if err := Insert(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attachments(ctx, "r1", "u1", []string{first.Id.Hex()}); err != ErrInvalidAttachment {
+		t.Fatalf("reusing a sent upload: got %v, want ErrInvalidAttachment", err)
+	}
+
+	if _, err := Delete(ctx, &models.Conversation{RoomId: "r1"}, msg.Id.Hex(), "u1"); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := find(ctx, "r1", msg.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Attachments) != 0 {
+		t.Fatalf("deleted message kept %d attachments", len(stored.Attachments))
+	}
+	for _, attachment := range []models.Attachment{first, second, otherUser} {
+		deleted, err := AttachmentDeleted(ctx, attachment.Key)
+		if err != nil || deleted != (attachment.Id != otherUser.Id) {
+			t.Errorf("%s: deleted %v (%v)", attachment.Name, deleted, err)
+		}
+	}
+}
+
+// TestInsertRetry sends a message with attachments twice under one
+// ClientId, then tries to reuse its upload in another message.
+func TestInsertRetry(t *testing.T) {
+	useTestDatabase(t)
+	ctx := context.Background()
+	_, err := MessageCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"client_id": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := upload(t, "r1", "u1", "a.txt")
+	send := func(clientId string) (*models.Message, error) {
+		msg := &models.Message{
+			Id:          primitive.NewObjectID(),
+			RoomId:      "r1",
+			UserId:      "u1",
+			ClientId:    clientId,
+			Type:        models.MessageTypeText,
+			Attachments: []models.Attachment{file},
+			CreatedAt:   time.Now(),
+		}
+		return msg, Insert(ctx, msg)
+	}
+
+	first, err := send("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := Retried(ctx, "r1", "u1", "c1")
+	if err != nil || stored == nil || stored.Id != first.Id {
+		t.Fatalf("Retried got %v, %v; want the first send", stored, err)
+	}
+	retry, err := send("c1")
+	if err != ErrDuplicate || retry.Id != first.Id {
+		t.Fatalf("retry got %v, %v; want ErrDuplicate with the first send", retry.Id, err)
+	}
+
+	other, err := send("c2")
+	if err != ErrInvalidAttachment {
+		t.Fatalf("reusing the upload: got %v, want ErrInvalidAttachment", err)
+	}
+	if MessageCollection.FindOne(ctx, bson.M{"_id": other.Id}).Err() != mongo.ErrNoDocuments {
+		t.Fatal("message that lost its attachment was kept")
+	}
+	var claimed bson.M
+	if err := AttachmentCollection.FindOne(ctx, bson.M{"_id": file.Id}).Decode(&claimed); err != nil {
+		t.Fatal(err)
+	}
+	if claimed["message_id"] != first.Id {
+		t.Fatalf("upload claimed by %v, want %v", claimed["message_id"], first.Id)
+	}
+}
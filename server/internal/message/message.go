@@ -0,0 +1,276 @@
+package message
+
+import (
+	"chat-server/db"
+	"chat-server/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var MessageCollection = db.MessageData(db.Client, "messages")
+var ConversationCollection = db.ConversationData(db.Client, "conversations")
+
+var (
+	ErrInvalidId   = errors.New("invalid message ID")
+	ErrNotFound    = errors.New("message not found")
+	ErrForbidden   = errors.New("only the author or an admin can change this message")
+	ErrNotEditable = errors.New("this message can no longer be edited")
+	ErrDuplicate   = errors.New("message was already sent")
+	ErrNotARoot    = errors.New("threads can only start from a message in the room timeline")
+)
+
+// previewLength caps the quoted content copied into a reply, in runes.
+const previewLength = 200
+
+// Insert stores a new message and makes it the conversation's preview. The
+// preview only moves forward, so a slow insert cannot replace a newer one.
+// When the sender already stored a message with the same ClientId in the
+// room, message is replaced by the stored one and ErrDuplicate is returned.
+func Insert(ctx context.Context, message *models.Message) error {
+	if _, err := MessageCollection.InsertOne(ctx, message); err != nil {
+		if message.ClientId == "" || !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		stored, err := Retried(ctx, message.RoomId, message.UserId, message.ClientId)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return ErrNotFound
+		}
+		*message = *stored
+		return ErrDuplicate
+	}
+	return afterInsert(ctx, message)
+}
+
+// Retried returns the message the user already sent to the room with the
+// given ClientId, or nil if there is none. If it was never announced the
+// steps after the insert run again, as the first attempt may have stopped
+// before them.
+func Retried(ctx context.Context, roomId string, userId string, clientId string) (*models.Message, error) {
+	var message models.Message
+	filter := bson.M{"room_id": roomId, "user_id": userId, "client_id": clientId}
+	err := MessageCollection.FindOne(ctx, filter).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !message.Announced {
+		if err := afterInsert(ctx, &message); err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
+}
+
+// afterInsert claims the message's attachments and moves the conversation
+// preview to it. Both are safe to repeat. A message that lost one of its
+// attachments to another message is removed again.
+func afterInsert(ctx context.Context, message *models.Message) error {
+	if err := claimAttachments(ctx, message); err != nil {
+		if err == ErrInvalidAttachment {
+			MessageCollection.DeleteOne(ctx, bson.M{"_id": message.Id})
+		}
+		return err
+	}
+	if message.ThreadId != "" {
+		return nil
+	}
+	_, err := ConversationCollection.UpdateOne(ctx,
+		bson.M{
+			"room_id": message.RoomId,
+			"$or": bson.A{
+				bson.M{"last_message": nil},
+				bson.M{"last_message.created_at": bson.M{"$lte": message.CreatedAt}},
+			},
+		},
+		bson.M{"$set": bson.M{"last_message": message, "updated_at": message.CreatedAt}})
+	return err
+}
+
+// refreshPreview rewrites the conversation preview if it shows the message
+// that was just edited or deleted, along with any replies quoting it.
+func refreshPreview(ctx context.Context, message *models.Message) error {
+	preview := *message
+	preview.EditHistory = nil
+	_, err := ConversationCollection.UpdateOne(ctx,
+		bson.M{"room_id": message.RoomId, "last_message._id": message.Id},
+		bson.M{"$set": bson.M{"last_message": preview}})
+	if err != nil {
+		return err
+	}
+	_, err = MessageCollection.UpdateMany(ctx,
+		bson.M{"room_id": message.RoomId, "reply_to._id": message.Id},
+		bson.M{"$set": bson.M{"reply_to": quote(message)}})
+	return err
+}
+
+func quote(message *models.Message) *models.MessagePreview {
+	content := []rune(message.Content)
+	if len(content) > previewLength {
+		content = append(content[:previewLength], '…')
+	}
+	return &models.MessagePreview{
+		Id:       message.Id,
+		UserId:   message.UserId,
+		Username: message.Username,
+		Content:  string(content),
+		Deleted:  message.Deleted,
+	}
+}
+
+// Quote returns the preview a reply to the given message carries.
+func Quote(ctx context.Context, roomId string, messageId string) (*models.MessagePreview, error) {
+	message, err := find(ctx, roomId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	return quote(message), nil
+}
+
+// ThreadRoot loads a message that replies can be threaded under. Replies
+// inside a thread cannot start threads of their own.
+func ThreadRoot(ctx context.Context, roomId string, messageId string) (*models.Message, error) {
+	message, err := find(ctx, roomId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if message.ThreadId != "" {
+		return nil, ErrNotARoot
+	}
+	return message, nil
+}
+
+// AddReply counts a stored thread reply on its root and returns the
+// updated root. The replies are counted rather than incremented so a
+// retried send does not count one twice.
+func AddReply(ctx context.Context, reply *models.Message) (*models.Message, error) {
+	rootId, err := primitive.ObjectIDFromHex(reply.ThreadId)
+	if err != nil {
+		return nil, ErrInvalidId
+	}
+	count, err := MessageCollection.CountDocuments(ctx, bson.M{"room_id": reply.RoomId, "thread_id": reply.ThreadId})
+	if err != nil {
+		return nil, err
+	}
+	var root models.Message
+	err = MessageCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": rootId, "room_id": reply.RoomId},
+		bson.M{
+			"$max":      bson.M{"reply_count": count, "last_reply_at": reply.CreatedAt},
+			"$addToSet": bson.M{"thread_participants": reply.UserId},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"edit_history": 0}),
+	).Decode(&root)
+	if err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// MarkAnnounced records that the message was broadcast.
+func MarkAnnounced(ctx context.Context, message *models.Message) error {
+	message.Announced = true
+	_, err := MessageCollection.UpdateOne(ctx, bson.M{"_id": message.Id}, bson.M{"$set": bson.M{"announced": true}})
+	return err
+}
+
+func find(ctx context.Context, roomId string, messageId string) (*models.Message, error) {
+	id, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrInvalidId
+	}
+	var message models.Message
+	err = MessageCollection.FindOne(ctx, bson.M{"_id": id, "room_id": roomId}).Decode(&message)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return &message, nil
+}
+
+// Edit replaces a message's content and appends the previous version to its
+// edit history.
+func Edit(ctx context.Context, conversation *models.Conversation, messageId string, userId string, content string) (*models.Message, error) {
+	message, err := find(ctx, conversation.RoomId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserId != userId && !conversation.IsAdmin(userId) {
+		return nil, ErrForbidden
+	}
+	// Messages stored before types existed have none and are all text.
+	if message.Deleted || message.Type != "" && message.Type != models.MessageTypeText {
+		return nil, ErrNotEditable
+	}
+	now := time.Now()
+	previous := models.MessageEdit{Content: message.Content, EditedBy: userId, EditedAt: now}
+	// Matching on the old content keeps two concurrent edits from both
+	// recording the same previous version.
+	result, err := MessageCollection.UpdateOne(ctx,
+		bson.M{"_id": message.Id, "content": message.Content, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set":  bson.M{"content": content, "edited": true, "edited_at": now},
+			"$push": bson.M{"edit_history": previous},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrNotEditable
+	}
+	message.Content = content
+	message.Edited = true
+	message.EditedAt = &now
+	message.EditHistory = append(message.EditHistory, previous)
+	return message, refreshPreview(ctx, message)
+}
+
+// History returns a message together with its earlier versions.
+func History(ctx context.Context, conversation *models.Conversation, messageId string) (*models.Message, error) {
+	return find(ctx, conversation.RoomId, messageId)
+}
+
+// Delete blanks a message, drops its edit history and marks it deleted. The
+// document is kept so replies still have something to point at.
+func Delete(ctx context.Context, conversation *models.Conversation, messageId string, userId string) (*models.Message, error) {
+	message, err := find(ctx, conversation.RoomId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserId != userId && !conversation.IsAdmin(userId) {
+		return nil, ErrForbidden
+	}
+	now := time.Now()
+	message.Content = ""
+	message.EditHistory = nil
+	message.Reactions = nil
+	message.Attachments = nil
+	message.Deleted = true
+	message.DeletedBy = userId
+	message.DeletedAt = &now
+	_, err = MessageCollection.UpdateOne(ctx, bson.M{"_id": message.Id}, bson.M{
+		"$set": bson.M{
+			"content":    message.Content,
+			"deleted":    true,
+			"deleted_by": userId,
+			"deleted_at": now,
+		},
+		"$unset": bson.M{"edit_history": "", "reactions": "", "attachments": ""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := removeAttachments(ctx, message); err != nil {
+		return nil, err
+	}
+	return message, refreshPreview(ctx, message)
+}
@@ -0,0 +1,185 @@
+package message
+
+import (
+	"chat-server/models"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("cursor must be a message ID or an RFC3339 timestamp")
+
+// PageQuery selects a window of messages. Before and After are exclusive
+// cursors, either a message _id or an RFC3339 timestamp; at most one is used,
+// with Before taking precedence. Around is a message _id to center the page
+// on, for jumping to a search result; it overrides the other two.
+type PageQuery struct {
+	Before string
+	After  string
+	Around string
+	Limit  int
+}
+
+// Page is newest first. HasOlder and HasNewer tell whether more messages
+// exist past the oldest and newest ones on the page. Only the direction that
+// was paged is checked: Before and unbounded queries report HasOlder, After
+// queries HasNewer and Around queries both.
+type Page struct {
+	Messages   []models.Message `json:"messages"`
+	HasOlder   bool             `json:"has_older"`
+	HasNewer   bool             `json:"has_newer"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
+}
+
+func ParseLimit(raw string) int {
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+// cursorBound turns a cursor into a (created_at, _id) position. Timestamps
+// have no _id, so every message at that instant is treated as past the
+// cursor.
+func cursorBound(ctx context.Context, cursor string) (time.Time, *primitive.ObjectID, error) {
+	if id, err := primitive.ObjectIDFromHex(cursor); err == nil {
+		var message models.Message
+		err := MessageCollection.FindOne(ctx, bson.M{"_id": id},
+			options.FindOne().SetProjection(bson.M{"created_at": 1})).Decode(&message)
+		if err != nil {
+			return time.Time{}, nil, ErrInvalidCursor
+		}
+		return message.CreatedAt, &id, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return time.Time{}, nil, ErrInvalidCursor
+	}
+	return t, nil, nil
+}
+
+func boundFilter(op string, t time.Time, id *primitive.ObjectID) bson.M {
+	if id == nil {
+		return bson.M{"created_at": bson.M{op: t}}
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{"created_at": bson.M{op: t}},
+		bson.M{"created_at": t, "_id": bson.M{op: *id}},
+	}}
+}
+
+// FindPage returns messages matching filter newest first. Ties on created_at
+// are broken by _id so pages never overlap or skip a message.
+func FindPage(ctx context.Context, filter bson.M, query PageQuery) (*Page, error) {
+	limit := query.Limit
+	if limit <= 0 || limit > MaxPageSize {
+		limit = DefaultPageSize
+	}
+	if query.Around != "" {
+		return findAround(ctx, filter, query.Around, limit)
+	}
+	conditions := bson.A{filter}
+	direction := -1
+	switch {
+	case query.Before != "":
+		t, id, err := cursorBound(ctx, query.Before)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, boundFilter("$lt", t, id))
+	case query.After != "":
+		t, id, err := cursorBound(ctx, query.After)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, boundFilter("$gt", t, id))
+		direction = 1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(bson.M{"edit_history": 0})
+	cursor, err := MessageCollection.Find(ctx, bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	messages := []models.Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	page := &Page{}
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if direction == -1 {
+		page.HasOlder = more
+	} else {
+		page.HasNewer = more
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	page.Messages = messages
+	if len(messages) > 0 {
+		page.PrevCursor = messages[0].Id.Hex()
+		page.NextCursor = messages[len(messages)-1].Id.Hex()
+	}
+	return page, nil
+}
+
+// findAround returns the message with the given _id and the messages on
+// either side of it, about half older and half newer.
+func findAround(ctx context.Context, filter bson.M, around string, limit int) (*Page, error) {
+	id, err := primitive.ObjectIDFromHex(around)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var target models.Message
+	err = MessageCollection.FindOne(ctx, bson.M{"$and": bson.A{filter, bson.M{"_id": id}}},
+		options.FindOne().SetProjection(bson.M{"edit_history": 0})).Decode(&target)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	olderLimit := limit / 2
+	if olderLimit < 1 {
+		olderLimit = 1
+	}
+	newerLimit := limit - olderLimit - 1
+	if newerLimit < 1 {
+		newerLimit = 1
+	}
+	older, err := FindPage(ctx, filter, PageQuery{Before: around, Limit: olderLimit})
+	if err != nil {
+		return nil, err
+	}
+	newer, err := FindPage(ctx, filter, PageQuery{After: around, Limit: newerLimit})
+	if err != nil {
+		return nil, err
+	}
+	messages := append(newer.Messages, target)
+	messages = append(messages, older.Messages...)
+	return &Page{
+		Messages:   messages,
+		HasOlder:   older.HasOlder,
+		HasNewer:   newer.HasNewer,
+		PrevCursor: messages[0].Id.Hex(),
+		NextCursor: messages[len(messages)-1].Id.Hex(),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"chat-server/models"
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidEmoji = errors.New("emoji must be a short string without spaces")
+
+// maxEmojiLength allows multi-codepoint emoji such as flags and skin tones.
+const maxEmojiLength = 16
+
+func validEmoji(emoji string) bool {
+	n := utf8.RuneCountInString(emoji)
+	return n > 0 && n <= maxEmojiLength && !strings.ContainsAny(emoji, " \t\r\n")
+}
+
+// React adds or removes the user's reaction with the given emoji. Asking for
+// the state a reaction is already in changes nothing, so retries are safe.
+// It returns the message's reactions and whether anything changed.
+func React(ctx context.Context, roomId string, messageId string, userId string, emoji string, reacted bool) ([]models.Reaction, bool, error) {
+	if !validEmoji(emoji) {
+		return nil, false, ErrInvalidEmoji
+	}
+	message, err := find(ctx, roomId, messageId)
+	if err != nil {
+		return nil, false, err
+	}
+	if message.Deleted {
+		return nil, false, ErrNotEditable
+	}
+	var changed bool
+	if reacted {
+		changed, err = addReaction(ctx, message, userId, emoji)
+	} else {
+		changed, err = removeReaction(ctx, message, userId, emoji)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var updated models.Message
+	err = MessageCollection.FindOne(ctx, bson.M{"_id": message.Id},
+		options.FindOne().SetProjection(bson.M{"reactions": 1})).Decode(&updated)
+	if err != nil {
+		return nil, false, err
+	}
+	return updated.Reactions, changed, nil
+}
+
+func addReaction(ctx context.Context, message *models.Message, userId string, emoji string) (bool, error) {
+	// Someone may add the same emoji between the two updates, so try again
+	// once if the new entry could not be pushed.
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := MessageCollection.UpdateOne(ctx,
+			bson.M{"_id": message.Id, "reactions": bson.M{"$elemMatch": bson.M{"emoji": emoji, "user_ids": bson.M{"$ne": userId}}}},
+			bson.M{
+				"$push": bson.M{"reactions.$[r].user_ids": userId},
+				"$inc":  bson.M{"reactions.$[r].count": 1},
+			},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"r.emoji": emoji}}}))
+		if err != nil {
+			return false, err
+		}
+		if result.ModifiedCount > 0 {
+			return true, nil
+		}
+		result, err = MessageCollection.UpdateOne(ctx,
+			bson.M{"_id": message.Id, "reactions.emoji": bson.M{"$ne": emoji}},
+			bson.M{"$push": bson.M{"reactions": models.Reaction{Emoji: emoji, UserIds: []string{userId}, Count: 1}}})
+		if err != nil {
+			return false, err
+		}
+		if result.ModifiedCount > 0 {
+			return true, nil
+		}
+		// The emoji is there; if the first update did not match either, the
+		// user had already reacted with it.
+		exists, err := MessageCollection.CountDocuments(ctx,
+			bson.M{"_id": message.Id, "reactions": bson.M{"$elemMatch": bson.M{"emoji": emoji, "user_ids": userId}}})
+		if err != nil || exists > 0 {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func removeReaction(ctx context.Context, message *models.Message, userId string, emoji string) (bool, error) {
+	result, err := MessageCollection.UpdateOne(ctx,
+		bson.M{"_id": message.Id, "reactions": bson.M{"$elemMatch": bson.M{"emoji": emoji, "user_ids": userId}}},
+		bson.M{
+			"$pull": bson.M{"reactions.$[r].user_ids": userId},
+			"$inc":  bson.M{"reactions.$[r].count": -1},
+		},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"r.emoji": emoji}}}))
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+	_, err = MessageCollection.UpdateOne(ctx,
+		bson.M{"_id": message.Id},
+		bson.M{"$pull": bson.M{"reactions": bson.M{"emoji": emoji, "count": bson.M{"$lte": 0}}}})
+	return true, err
+}
@@ -0,0 +1,172 @@
+package message
+
+import (
+	"chat-server/models"
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snippetRadius is how many runes of context a snippet keeps on each side
+// of the first match.
+const snippetRadius = 60
+
+// SearchQuery finds messages in RoomIds whose content matches Text, which
+// uses MongoDB text search syntax. The other fields narrow the results.
+type SearchQuery struct {
+	Text     string
+	RoomIds  []string
+	SenderId string
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+	Offset   int
+}
+
+// Highlight marks a matched term in a snippet, in runes.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchResult is a matching message with a short excerpt around the match.
+// Thread replies match too; they are paged with their thread, not the room,
+// so Context holds the request that opens the message where it lives.
+type SearchResult struct {
+	Message    models.Message `json:"message"`
+	Snippet    string         `json:"snippet"`
+	Highlights []Highlight    `json:"highlights"`
+	Score      float64        `json:"score"`
+	Context    string         `json:"context"`
+}
+
+// Search returns the best matches first, and whether there are more after
+// this page.
+func Search(ctx context.Context, query SearchQuery) ([]SearchResult, bool, error) {
+	limit := query.Limit
+	if limit <= 0 || limit > MaxPageSize {
+		limit = DefaultPageSize
+	}
+	filter := bson.M{
+		"$text":   bson.M{"$search": query.Text},
+		"room_id": bson.M{"$in": query.RoomIds},
+		"deleted": bson.M{"$ne": true},
+	}
+	if query.SenderId != "" {
+		filter["user_id"] = query.SenderId
+	}
+	created := bson.M{}
+	if query.From != nil {
+		created["$gte"] = *query.From
+	}
+	if query.To != nil {
+		created["$lte"] = *query.To
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	opts := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}, "edit_history": 0}).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "created_at", Value: -1}}).
+		SetSkip(int64(query.Offset)).
+		SetLimit(int64(limit + 1))
+	cursor, err := MessageCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+	var hits []struct {
+		models.Message `bson:",inline"`
+		Score          float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &hits); err != nil {
+		return nil, false, err
+	}
+	hasMore := len(hits) > limit
+	if hasMore {
+		hits = hits[:limit]
+	}
+	terms := searchTerms(query.Text)
+	results := make([]SearchResult, 0, len(hits))
+	for _, hit := range hits {
+		snippet, highlights := excerpt(hit.Content, terms)
+		results = append(results, SearchResult{
+			Message:    hit.Message,
+			Snippet:    snippet,
+			Highlights: highlights,
+			Score:      hit.Score,
+		})
+	}
+	return results, hasMore, nil
+}
+
+// searchTerms pulls the words to highlight out of a text search string,
+// skipping negated terms.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, field := range strings.Fields(strings.ReplaceAll(text, `"`, " ")) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+		terms = append(terms, strings.ToLower(field))
+	}
+	return terms
+}
+
+// excerpt cuts content down to a window around the first matched term and
+// marks every term found in it. The text index also matches other forms of
+// a word, so a message may have no literal match; it then starts at the
+// beginning with nothing marked.
+func excerpt(content string, terms []string) (string, []Highlight) {
+	runes := []rune(content)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	var matches []Highlight
+	for _, term := range terms {
+		needle := []rune(term)
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) == term {
+				matches = append(matches, Highlight{Start: i, End: i + len(needle)})
+			}
+		}
+	}
+	first := len(runes)
+	for _, match := range matches {
+		if match.Start < first {
+			first = match.Start
+		}
+	}
+	if len(matches) == 0 {
+		first = 0
+	}
+	start := first - snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := first + snippetRadius
+	if end > len(runes) {
+		end = len(runes)
+	}
+	snippet := string(runes[start:end])
+	offset := -start
+	if start > 0 {
+		snippet = "…" + snippet
+		offset++
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	highlights := []Highlight{}
+	for _, match := range matches {
+		if match.Start >= start && match.End <= end {
+			highlights = append(highlights, Highlight{Start: match.Start + offset, End: match.End + offset})
+		}
+	}
+	return snippet, highlights
+}
@@ -0,0 +1,174 @@
+package user
+
+import (
+	"chat-server/db"
+	"chat-server/models"
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ConversationCollection = db.ConversationData(db.Client, "conversations")
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+// DirectoryEntry is what a user search shows of another user. RoomId is the
+// direct conversation the caller already has with them, if any.
+type DirectoryEntry struct {
+	UserId             string `json:"id"`
+	Username           string `json:"username"`
+	Email              string `json:"email"`
+	Image              string `json:"image"`
+	ConversationExists bool   `json:"conversation_exists"`
+	RoomId             string `json:"room_id,omitempty"`
+}
+
+// SearchUsers looks up verified users whose username or email starts with
+// q, ignoring case; a username also matches on the start of any later word.
+// Users the caller blocked, or who blocked the caller, are left out. limit
+// and offset page through the results in username order.
+//
+// Without q it falls back to the old exact match on the email parameter.
+func SearchUsers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		var caller models.User
+		if err := UserCollection.FindOne(ctx, bson.M{"user_id": user_id}).Decode(&caller); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return
+		}
+		filter := bson.M{
+			"user_id":       bson.M{"$nin": append([]string{user_id}, caller.BlockedUsers...)},
+			"blocked_users": bson.M{"$ne": user_id},
+			"verified":      true,
+		}
+		q := c.Query("q")
+		if q == "" {
+			lookupByEmail(c, ctx, filter)
+			return
+		}
+		prefix := regexp.QuoteMeta(q)
+		filter["$or"] = bson.A{
+			bson.M{"username": bson.M{"$regex": `(^|\s)` + prefix, "$options": "i"}},
+			bson.M{"email": bson.M{"$regex": "^" + prefix, "$options": "i"}},
+		}
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			limit = defaultSearchLimit
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		opts := options.Find().
+			SetProjection(bson.M{"user_id": 1, "username": 1, "email": 1, "image": 1}).
+			SetSort(bson.D{{Key: "username", Value: 1}, {Key: "user_id", Value: 1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit + 1))
+		cursor, err := UserCollection.Find(ctx, filter, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users", "message": err.Error()})
+			return
+		}
+		var users []models.User
+		if err := cursor.All(ctx, &users); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode users", "message": err.Error()})
+			return
+		}
+		hasMore := len(users) > limit
+		if hasMore {
+			users = users[:limit]
+		}
+		rooms, err := directRooms(ctx, user_id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations", "message": err.Error()})
+			return
+		}
+		entries := make([]DirectoryEntry, 0, len(users))
+		for _, found := range users {
+			entries = append(entries, DirectoryEntry{
+				UserId:             found.UserId,
+				Username:           found.Username,
+				Email:              found.Email,
+				Image:              found.Image,
+				ConversationExists: rooms[found.UserId] != "",
+				RoomId:             rooms[found.UserId],
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Users fetched successfully",
+			"data":     entries,
+			"has_more": hasMore,
+		})
+	}
+}
+
+func lookupByEmail(c *gin.Context, ctx context.Context, filter bson.M) {
+	filter["email"] = c.Query("email")
+	var user models.User
+	if err := UserCollection.FindOne(ctx, filter).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found", "message": "Please check the email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"email": user.Email, "username": user.Username, "id": user.UserId, "image": user.Image})
+}
+
+// directRooms maps everyone the user has a one-to-one conversation with to
+// its room_id.
+func directRooms(ctx context.Context, userId string) (map[string]string, error) {
+	cursor, err := ConversationCollection.Find(ctx,
+		bson.M{"is_group": bson.M{"$ne": true}, "participants.id": userId},
+		options.Find().SetProjection(bson.M{"room_id": 1, "participants.id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var conversations []models.Conversation
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	rooms := make(map[string]string)
+	for _, conversation := range conversations {
+		for _, participant := range conversation.Participants {
+			if participant.Id != userId {
+				rooms[participant.Id] = conversation.RoomId
+			}
+		}
+	}
+	return rooms, nil
+}
+
+// BlockUser hides another user from the caller's directory searches and the
+// caller from theirs. DELETE on the same route undoes it.
+func BlockUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user_id := c.GetString("user_id")
+		target := c.Param("user_id")
+		if target == user_id {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+			return
+		}
+		update := bson.M{"$addToSet": bson.M{"blocked_users": target}}
+		if c.Request.Method == http.MethodDelete {
+			update = bson.M{"$pull": bson.M{"blocked_users": target}}
+		}
+		if _, err := UserCollection.UpdateOne(ctx, bson.M{"user_id": user_id}, update); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update blocked users", "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Blocked users updated successfully"})
+	}
+}
@@ -12,10 +12,6 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/markbates/goth/gothic"
 	"go.mongodb.org/mongo-driver/bson"
@@ -163,21 +159,6 @@ func LoginUser() gin.HandlerFunc {
 		}})
 	}
 }
-func GetUserByEmail() gin.HandlerFunc {
-	fmt.Println("Email to search:")
-	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		email := c.Query("email")
-		var user models.User
-		err := UserCollection.FindOne(ctx, primitive.M{"email": email}).Decode(&user)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found", "message": "Please check the email"})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"email": user.Email, "username": user.Username, "id": user.UserId, "image": user.Image})
-	}
-}
 func SocialLogin() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		provider := c.Param("provider")
@@ -307,36 +288,34 @@ func UploadHandler(c *gin.Context) {
 	}
 	filter := bson.M{"user_id": userId.(string)}
 
-	file, header, err := c.Request.FormFile("file")
+	file, _, err := c.Request.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
 		return
 	}
 	defer file.Close()
-
-	// 2. Load AWS config (uses env vars or shared config files)
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"), // replace with your actual bucket's region
-	)
+	// The type comes from the file itself; it is what the image is served as.
+	contentType, err := services.SniffType(file)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "AWS config error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file", "message": err.Error()})
+		return
+	}
+	if !services.IsImage(contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Profile images must be JPEG, PNG, GIF or WebP"})
 		return
 	}
 
-	svc := s3.NewFromConfig(cfg)
-	uploader := manager.NewUploader(svc)
-
-	result, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String("gochatappimages"),
-		Key:         aws.String(userId.(string)),
-		Body:        file,
-		ContentType: aws.String(header.Header.Get("Content-Type")),
-	})
+	storage, err := services.DefaultStorage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	location, err := storage.Put(c.Request.Context(), userId.(string), file, contentType)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	update := bson.M{"$set": bson.M{"image": result.Location}}
+	update := bson.M{"$set": bson.M{"image": location}}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_, err = UserCollection.UpdateOne(ctx, filter, update)
@@ -345,5 +324,5 @@ func UploadHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Image uploaded successfully", "image_url": result.Location})
+	c.JSON(http.StatusOK, gin.H{"message": "Image uploaded successfully", "image_url": location})
 }
@@ -0,0 +1,215 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Backplane carries hub events between server instances. Every instance
+// publishes what it delivers to its own clients and receives what the
+// others publish, including its own events, which the hub ignores.
+type Backplane interface {
+	Publish(ctx context.Context, data []byte) error
+	// Subscribe returns every event published from now on. The channel is
+	// closed when ctx is done.
+	Subscribe(ctx context.Context) (<-chan []byte, error)
+}
+
+// MemoryBackplane connects hubs running in the same process.
+type MemoryBackplane struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subscribers: make(map[chan []byte]bool)}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- data:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	subscriber := make(chan []byte, 256)
+	b.mu.Lock()
+	b.subscribers[subscriber] = true
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subscribers, subscriber)
+		b.mu.Unlock()
+		close(subscriber)
+	}()
+	return subscriber, nil
+}
+
+// MongoBackplane publishes events as documents in a collection and follows
+// it with a change stream, so it needs MongoDB running as a replica set. A
+// TTL index (see db.CreateIndexes) clears old events.
+type MongoBackplane struct {
+	collection *mongo.Collection
+}
+
+func NewMongoBackplane(collection *mongo.Collection) *MongoBackplane {
+	return &MongoBackplane{collection: collection}
+}
+
+func (b *MongoBackplane) Publish(ctx context.Context, data []byte) error {
+	_, err := b.collection.InsertOne(ctx, bson.M{"data": string(data), "created_at": time.Now()})
+	return err
+}
+
+func (b *MongoBackplane) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	stream, err := b.collection.Watch(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan []byte, 256)
+	go func() {
+		defer close(events)
+		for {
+			for stream.Next(ctx) {
+				var change struct {
+					FullDocument struct {
+						Data string `bson:"data"`
+					} `bson:"fullDocument"`
+				}
+				if err := stream.Decode(&change); err != nil {
+					log.Println("Error decoding backplane event:", err)
+					continue
+				}
+				events <- []byte(change.FullDocument.Data)
+			}
+			if ctx.Err() != nil {
+				stream.Close(context.Background())
+				return
+			}
+			// Pick the stream up where it broke off.
+			log.Println("Backplane change stream stopped:", stream.Err())
+			resumeToken := stream.ResumeToken()
+			stream.Close(context.Background())
+			for {
+				time.Sleep(time.Second)
+				opts := options.ChangeStream().SetResumeAfter(resumeToken)
+				stream, err = b.collection.Watch(ctx, pipeline, opts)
+				if err == nil {
+					break
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				log.Println("Error reopening backplane change stream:", err)
+			}
+		}
+	}()
+	return events, nil
+}
+
+// busEvent is what one hub tells the others. Exactly one of the pointers
+// is set.
+type busEvent struct {
+	Node       string            `json:"node"`
+	Room       *roomBroadcast    `json:"room,omitempty"`
+	Membership *MembershipUpdate `json:"membership,omitempty"`
+	Presence   *nodePresence     `json:"presence,omitempty"`
+	Status     *StatusUpdate     `json:"status,omitempty"`
+}
+
+// roomBroadcast carries the room's members along with the event, so a node
+// without subscribers to the room can still notify members connected to it.
+type roomBroadcast struct {
+	RoomEvent
+	Members []string `json:"members,omitempty"`
+}
+
+// nodePresence is a user's presence as seen from a single node.
+type nodePresence struct {
+	Contacts []string        `json:"contacts"`
+	Presence PresencePayload `json:"presence"`
+}
+
+// publish hands an event to the backplane without blocking the hub.
+func (h *Hub) publish(event *busEvent) {
+	if h.config.Backplane == nil {
+		return
+	}
+	event.Node = h.node
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error encoding backplane event:", err)
+		return
+	}
+	select {
+	case h.outbox <- data:
+	default:
+		log.Println("Backplane outbox full, dropping event")
+	}
+}
+
+// relay publishes queued events in order.
+func (h *Hub) relay() {
+	for data := range h.outbox {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := h.config.Backplane.Publish(ctx, data); err != nil {
+			log.Println("Error publishing backplane event:", err)
+		}
+		cancel()
+	}
+}
+
+// listen feeds events published by other nodes into the hub.
+func (h *Hub) listen() {
+	events, err := h.config.Backplane.Subscribe(context.Background())
+	if err != nil {
+		log.Println("Error subscribing to backplane:", err)
+		return
+	}
+	for data := range events {
+		var event busEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Println("Error decoding backplane event:", err)
+			continue
+		}
+		if event.Node == h.node {
+			continue
+		}
+		h.remote <- &event
+	}
+}
+
+// receive applies an event from another node to the local clients.
+func (h *Hub) receive(event *busEvent) {
+	switch {
+	case event.Room != nil:
+		members := make(map[string]bool, len(event.Room.Members))
+		for _, memberId := range event.Room.Members {
+			members[memberId] = true
+		}
+		h.deliver(&event.Room.RoomEvent, members)
+	case event.Membership != nil:
+		h.updateMembership(event.Membership)
+	case event.Presence != nil:
+		expires := time.Now().Add(3 * presenceHeartbeat)
+		h.setNodePresence(event.Node, event.Presence.Presence, event.Presence.Contacts, expires)
+	case event.Status != nil:
+		h.setStatus(event.Status)
+	}
+}
@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"chat-server/db/dbtest"
+	"chat-server/models"
+)
+
+// testTwoHubs runs two hubs on one backplane, as two server instances
+// would, and checks that events reach clients on the other one. settle is
+// how long the backplane needs before it delivers.
+func testTwoHubs(t *testing.T, backplane Backplane, settle time.Duration) {
+	cfg := DefaultConfig()
+	cfg.Backplane = backplane
+	a, b := NewHubWithConfig(cfg), NewHubWithConfig(cfg)
+	go a.Run()
+	go b.Run()
+	time.Sleep(settle)
+
+	members := []models.Participant{{Id: "x"}, {Id: "y"}, {Id: "z"}}
+	x := newTestClient(a, "x", []string{"y", "z"})
+	y := newTestClient(b, "y", []string{"x", "z"})
+	z := newTestClient(b, "z", []string{"x", "y"})
+	a.Register <- x
+	b.Register <- y
+	expect(t, y, EventPresence, presenceOf("x", true))
+	b.Register <- z
+
+	// y is subscribed on b, x on a.
+	b.Subscribe <- &Subscription{Client: y, RoomId: "r", Members: members}
+	expect(t, y, EventSubscribed, nil)
+	a.Subscribe <- &Subscription{Client: x, RoomId: "r", Members: members}
+	expect(t, x, EventSubscribed, nil)
+	a.BroadcastMessage(&models.Message{RoomId: "r", UserId: "x", Content: "hello"})
+	expect(t, y, EventMessage, nil)
+	// z is a member who is connected to b but not looking at the room.
+	expect(t, z, EventNotification, nil)
+
+	// A status set through a reaches y's contacts on both nodes.
+	a.Status <- &StatusUpdate{UserId: "y", Status: models.StatusDoNotDisturb, Text: "busy"}
+	expect(t, x, EventPresence, func(data json.RawMessage) bool {
+		var presence PresencePayload
+		return json.Unmarshal(data, &presence) == nil && presence.UserId == "y" && presence.Status == models.StatusDoNotDisturb
+	})
+	if presence, ok := a.Presence("y"); !ok || presence.StatusText != "busy" {
+		t.Fatalf("a sees y as %+v", presence)
+	}
+
+	b.Unregister <- y
+	expect(t, x, EventPresence, presenceOf("y", false))
+
+	// x stays online while a second device is connected to b.
+	x2 := newTestClient(b, "x", []string{"y", "z"})
+	b.Register <- x2
+	time.Sleep(settle)
+	a.Unregister <- x
+	time.Sleep(settle)
+	if _, ok := b.Presence("x"); !ok {
+		t.Fatal("x went offline on b with a device still connected")
+	}
+	if _, ok := a.Presence("x"); !ok {
+		t.Fatal("x went offline on a with a device still connected to b")
+	}
+}
+
+func TestHubNodes(t *testing.T) {
+	testTwoHubs(t, NewMemoryBackplane(), 100*time.Millisecond)
+}
+
+// TestHubNodeExpiry checks that users reported by a node that stops
+// repeating them go offline.
+func TestHubNodeExpiry(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backplane = NewMemoryBackplane()
+	h := NewHubWithConfig(cfg)
+	// The hub is not running, so the test owns its state.
+	y := newTestClient(h, "y", []string{"x"})
+	h.users["y"] = map[*Client]bool{y: true}
+	h.receive(&busEvent{Node: "gone", Presence: &nodePresence{
+		Contacts: []string{"y"},
+		Presence: PresencePayload{UserId: "x", Online: true, Status: models.StatusAvailable},
+	}})
+	expect(t, y, EventPresence, presenceOf("x", true))
+
+	h.sweepPresence(time.Now().Add(presenceHeartbeat))
+	if _, ok := h.Presence("x"); !ok {
+		t.Fatal("x expired before missing three heartbeats")
+	}
+	h.sweepPresence(time.Now().Add(4 * presenceHeartbeat))
+	expect(t, y, EventPresence, presenceOf("x", false))
+	if _, ok := h.Presence("x"); ok {
+		t.Fatal("x is still online after its node stopped reporting")
+	}
+}
+
+// TestMongoBackplane needs MongoDB running as a replica set, for change
+// streams; make test-mongo starts one in Docker.
+func TestMongoBackplane(t *testing.T) {
+	collection := dbtest.Database(t).Collection("hub_events")
+	testTwoHubs(t, NewMongoBackplane(collection), time.Second)
+}
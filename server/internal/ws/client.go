@@ -1,82 +1,512 @@
 package ws
 
 import (
+	"chat-server/internal/message"
 	"chat-server/models"
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	// writeWait bounds how long a single frame may take to write.
+	writeWait = 10 * time.Second
+	// pongWait is how long the connection may stay silent before it is
+	// considered dead. Every pong or frame from the client resets it.
+	pongWait = 60 * time.Second
+	// pingPeriod must be shorter than pongWait so a healthy client always
+	// has a pong in flight before the deadline.
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize caps a single incoming frame.
+	maxMessageSize = 64 * 1024
+)
+
+// Client is one user's socket. Message is its buffered send queue; when it
+// fills up the hub applies its OverflowPolicy. rooms, replaying and closed
+// are only touched by the hub goroutine.
 type Client struct {
 	ID       string `json:"id"`
 	Conn     *websocket.Conn
-	Message  chan *models.Message
-	RoomId   string `json:"room_id"`
-	Username string `json:"username"`
-}
+	Message  chan *Envelope
+	Username string   `json:"username"`
+	Contacts []string `json:"contacts"`
+	rooms    map[string]bool
+	closed   bool
+	// replaying holds live events for rooms whose replay is still loading.
+	replaying map[string][]*RoomEvent
+	// status is the stored status read when the socket opened.
+	status StatusUpdate
+	// lastActive is the UnixNano time of the last frame from the client.
+	lastActive atomic.Int64
 
-var Rooms = make(map[string]*Room)
+	mu      sync.Mutex
+	backlog []*Envelope
+	wake    chan struct{}
+}
 
 type Message models.Message
 type Room struct {
-	ID      string             `json:"name"`
-	Clients map[string]*Client `json:"clients"`
+	ID      string           `json:"name"`
+	Clients map[*Client]bool `json:"-"`
+	Members map[string]bool  `json:"members"`
+}
+
+func memberSet(participants []models.Participant) map[string]bool {
+	members := make(map[string]bool, len(participants))
+	for _, p := range participants {
+		members[p.Id] = true
+	}
+	return members
 }
 
 func (cl *Client) WriteMessage() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		cl.Conn.Close()
 	}()
 	for {
-		msg, ok := <-cl.Message
-		if !ok {
-			return
+		select {
+		case msg, ok := <-cl.Message:
+			if !ok {
+				cl.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				cl.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := cl.write(msg); err != nil {
+				return
+			}
+		case <-cl.wake:
+			// The queue holds events older than the backlog, so flush it
+			// first to keep delivery in order.
+			for n := len(cl.Message); n > 0; n-- {
+				msg, ok := <-cl.Message
+				if !ok {
+					return
+				}
+				if err := cl.write(msg); err != nil {
+					return
+				}
+			}
+			for _, msg := range cl.takeBacklog() {
+				if err := cl.write(msg); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			cl.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := cl.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("Ping failed for client:", cl.ID, err)
+				return
+			}
 		}
-		fmt.Println("Sending message to client:", cl.ID, "in room:", cl.RoomId, "Content:", msg.Content)
-		if err := cl.Conn.WriteJSON(msg); err != nil {
-			return
+	}
+}
+
+func (cl *Client) write(msg *Envelope) error {
+	if msg.batch != nil {
+		for _, item := range msg.batch {
+			if err := cl.write(item); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
+	cl.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return cl.Conn.WriteJSON(msg)
 }
+
 func (cl *Client) ReadMessage(hub *Hub) {
 	defer func() {
 		fmt.Println("------Closing connection for client-------:", cl.ID)
 		hub.Unregister <- cl
 		cl.Conn.Close()
 	}()
+	cl.Conn.SetReadLimit(maxMessageSize)
+	cl.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	cl.Conn.SetPongHandler(func(string) error {
+		return cl.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
 	for {
-		_, msg, err := cl.Conn.ReadMessage()
+		_, data, err := cl.Conn.ReadMessage()
 
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("Connection lost for client:", cl.ID, err)
+			}
 			return
 		}
+		cl.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		cl.lastActive.Store(time.Now().UnixNano())
+		envelope, err := ParseEnvelope(data)
+		if err != nil {
+			cl.reply(hub, NewErrorEnvelope("", "bad_request", err.Error()))
+			continue
+		}
+
+		var target SubscribePayload
+		if err := envelope.Decode(&target); err != nil || target.RoomId == "" {
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", "room_id is required"))
+			continue
+		}
+		if envelope.Type == EventUnsubscribe {
+			hub.Unsubscribe <- &Subscription{Client: cl, RoomId: target.RoomId}
+			continue
+		}
+
+		// Membership can change while the socket is open, so it is checked
+		// against the stored conversation on every frame.
+		conversation, err := getConversationByRoomId(target.RoomId)
+		if err != nil {
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, "not_found", "Room not found"))
+			continue
+		}
+		if conversation.Participant(cl.ID) == nil {
+			log.Println("Rejecting frame from non-member:", cl.ID, "in room:", target.RoomId)
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, "forbidden", "You are not a member of this room"))
+			continue
+		}
 
-		// Create a new context for each message insertion
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		log.Println("Received message from client:", cl.ID, "in room:", cl.RoomId, "Content:", string(msg))
-		userMessage := &models.Message{
-			Id:        primitive.NewObjectID(),
-			RoomId:    cl.RoomId,
-			Content:   string(msg),
-			Username:  cl.Username,
-			UserId:    cl.ID,
-			CreatedAt: time.Now(),
+		switch envelope.Type {
+		case EventSubscribe:
+			hub.Subscribe <- &Subscription{
+				Client:  cl,
+				RoomId:  target.RoomId,
+				Members: conversation.Participants,
+				Replay:  target.Since != "",
+			}
+			if target.Since != "" {
+				cl.replay(hub, envelope.Id, target.RoomId, target.Since)
+			}
+		case EventMessage:
+			cl.handleSend(hub, conversation, envelope)
+		case EventTyping:
+			var payload TypingPayload
+			if err := envelope.Decode(&payload); err != nil {
+				cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", err.Error()))
+				continue
+			}
+			payload.UserId = cl.ID
+			payload.Username = cl.Username
+			hub.Typing <- &payload
+		case EventReceipt:
+			cl.handleReceipt(hub, envelope)
+		case EventAck:
+			cl.handleAck(hub, envelope)
+		case EventEdit:
+			cl.handleEdit(hub, conversation, envelope)
+		case EventDelete:
+			cl.handleDelete(hub, conversation, envelope)
+		case EventReaction:
+			cl.handleReaction(hub, envelope)
+		default:
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, "unsupported", "Unsupported event type: "+envelope.Type))
 		}
+	}
+}
+
+func (cl *Client) reply(hub *Hub, envelope *Envelope) {
+	hub.Direct <- &DirectEvent{Client: cl, Envelope: envelope}
+}
 
-		_, err = MessageCollection.InsertOne(ctx, userMessage)
-		cancel() // Cancel the context after the operation completes
+func (cl *Client) handleSend(hub *Hub, conversation *models.Conversation, envelope *Envelope) {
+	var payload SendMessagePayload
+	if err := envelope.Decode(&payload); err != nil || payload.Content == "" && len(payload.AttachmentIds) == 0 {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", "Message content is required"))
+		return
+	}
 
+	// Create a new context for each message insertion
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	log.Println("Received message from client:", cl.ID, "in room:", payload.RoomId)
+	// A retry is answered with the stored message before its attachments
+	// are checked, since by now they are claimed by it.
+	if payload.ClientId != "" {
+		stored, err := message.Retried(ctx, payload.RoomId, cl.ID, payload.ClientId)
+		if err != nil {
+			log.Println("Error loading retried message:", err)
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), "Failed to save message"))
+			return
+		}
+		if stored != nil {
+			cl.confirm(ctx, hub, conversation, envelope.Id, stored)
+			return
+		}
+	}
+	userMessage := &models.Message{
+		Id:        primitive.NewObjectID(),
+		RoomId:    payload.RoomId,
+		Type:      models.MessageTypeText,
+		Content:   payload.Content,
+		Username:  cl.Username,
+		UserId:    cl.ID,
+		ClientId:  payload.ClientId,
+		ThreadId:  payload.ThreadId,
+		CreatedAt: time.Now(),
+	}
+	if payload.ReplyTo != "" {
+		quoted, err := message.Quote(ctx, payload.RoomId, payload.ReplyTo)
+		if err != nil {
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+			return
+		}
+		userMessage.ReplyTo = quoted
+	}
+	if len(payload.AttachmentIds) > 0 {
+		attachments, err := message.Attachments(ctx, payload.RoomId, cl.ID, payload.AttachmentIds)
 		if err != nil {
-			log.Println("Error inserting message:", err)
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
 			return
 		}
+		userMessage.Attachments = attachments
+	}
+	if payload.ThreadId != "" {
+		if _, err := message.ThreadRoot(ctx, payload.RoomId, payload.ThreadId); err != nil {
+			cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+			return
+		}
+	}
 
-		hub.Broadcast <- userMessage
+	err := message.Insert(ctx, userMessage)
+	if err == message.ErrInvalidAttachment {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	if err != nil && err != message.ErrDuplicate {
+		log.Println("Error inserting message:", err)
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "internal", "Failed to save message"))
+		return
+	}
+	cl.confirm(ctx, hub, conversation, envelope.Id, userMessage)
+}
+
+// confirm acks a stored message to its sender and broadcasts it. A retry of
+// a message that was already broadcast only needs the ack. If the first
+// attempt stopped before the broadcast it is sent now; subscribers drop a
+// message they already have by its _id.
+func (cl *Client) confirm(ctx context.Context, hub *Hub, conversation *models.Conversation, id string, userMessage *models.Message) {
+	sent := NewEnvelope(EventSent, &SentPayload{
+		RoomId:    userMessage.RoomId,
+		ClientId:  userMessage.ClientId,
+		MessageId: userMessage.Id.Hex(),
+		CreatedAt: userMessage.CreatedAt,
+	})
+	sent.Id = id
+	cl.reply(hub, sent)
+	if userMessage.Announced {
+		return
+	}
+	cl.announce(ctx, hub, conversation, userMessage)
+}
+
+// announce broadcasts a stored message and records that it was.
+func (cl *Client) announce(ctx context.Context, hub *Hub, conversation *models.Conversation, userMessage *models.Message) {
+	if userMessage.ThreadId != "" {
+		root, err := message.AddReply(ctx, userMessage)
+		if err != nil {
+			log.Println("Error counting thread reply:", err)
+			return
+		}
+		hub.BroadcastThreadReply(userMessage, root, threadParticipants(conversation, root))
+	} else {
+		hub.BroadcastMessage(userMessage)
+		hub.Typing <- &TypingPayload{RoomId: userMessage.RoomId, UserId: cl.ID, Username: cl.Username, Typing: false}
+	}
+	if err := message.MarkAnnounced(ctx, userMessage); err != nil {
+		log.Println("Error marking message announced:", err)
+	}
+}
+
+// threadParticipants is the root's author and everyone who replied, limited
+// to current members of the conversation.
+func threadParticipants(conversation *models.Conversation, root *models.Message) []string {
+	var participants []string
+	for _, userId := range append([]string{root.UserId}, root.ThreadParticipants...) {
+		if conversation.Participant(userId) != nil {
+			participants = append(participants, userId)
+		}
+	}
+	return participants
+}
+
+// advanceMarker moves one of the caller's per-conversation markers, "read"
+// or "delivered", forward to the given message. It reports false when the
+// marker is already at or past that message, so a late frame from another
+// device cannot move it back.
+func (cl *Client) advanceMarker(ctx context.Context, roomId, messageId, marker string) (bool, error) {
+	id, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return false, message.ErrInvalidId
+	}
+	var target models.Message
+	err = MessageCollection.FindOne(ctx, bson.M{"_id": id, "room_id": roomId}).Decode(&target)
+	if err != nil {
+		return false, message.ErrNotFound
+	}
+	at := "last_" + marker + "_at"
+	result, err := ConversationCollection.UpdateOne(ctx,
+		bson.M{
+			"room_id": roomId,
+			"participants": bson.M{"$elemMatch": bson.M{
+				"id": cl.ID,
+				"$or": bson.A{
+					bson.M{at: bson.M{"$lt": target.CreatedAt}},
+					bson.M{at: bson.M{"$exists": false}},
+				},
+			}},
+		},
+		bson.M{"$set": bson.M{
+			"participants.$." + at:                          target.CreatedAt,
+			"participants.$.last_" + marker + "_message_id": messageId,
+		}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// handleReceipt advances the sender's read marker to the given message and
+// tells the room.
+func (cl *Client) handleReceipt(hub *Hub, envelope *Envelope) {
+	var payload ReceiptPayload
+	if err := envelope.Decode(&payload); err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", err.Error()))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	moved, err := cl.advanceMarker(ctx, payload.RoomId, payload.MessageId, "read")
+	if err != nil {
+		log.Println("Error updating read marker:", err)
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	if !moved {
+		return
+	}
+	hub.BroadcastEvent(payload.RoomId, cl.ID, EventReceipt, &ReceiptPayload{
+		RoomId:    payload.RoomId,
+		UserId:    cl.ID,
+		MessageId: payload.MessageId,
+		ReadAt:    time.Now(),
+	})
+}
+
+// handleAck records that one of the sender's devices received a message and
+// tells the room, so the author can show it as delivered.
+func (cl *Client) handleAck(hub *Hub, envelope *Envelope) {
+	var payload AckPayload
+	if err := envelope.Decode(&payload); err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", err.Error()))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	moved, err := cl.advanceMarker(ctx, payload.RoomId, payload.MessageId, "delivered")
+	if err != nil {
+		log.Println("Error updating delivery marker:", err)
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	if !moved {
+		return
+	}
+	hub.BroadcastEvent(payload.RoomId, cl.ID, EventDelivered, &DeliveredPayload{
+		RoomId:      payload.RoomId,
+		UserId:      cl.ID,
+		MessageId:   payload.MessageId,
+		DeliveredAt: time.Now(),
+	})
+}
+
+func (cl *Client) handleEdit(hub *Hub, conversation *models.Conversation, envelope *Envelope) {
+	var payload EditPayload
+	if err := envelope.Decode(&payload); err != nil || payload.Content == "" {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", "Message content is required"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	edited, err := message.Edit(ctx, conversation, payload.MessageId, cl.ID, payload.Content)
+	if err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	hub.BroadcastEvent(conversation.RoomId, cl.ID, EventEdit, &EditPayload{
+		RoomId:    edited.RoomId,
+		MessageId: edited.Id.Hex(),
+		Content:   edited.Content,
+		EditedAt:  edited.EditedAt,
+	})
+}
+
+func (cl *Client) handleDelete(hub *Hub, conversation *models.Conversation, envelope *Envelope) {
+	var payload DeletePayload
+	if err := envelope.Decode(&payload); err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", err.Error()))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deleted, err := message.Delete(ctx, conversation, payload.MessageId, cl.ID)
+	if err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	hub.BroadcastEvent(conversation.RoomId, cl.ID, EventDelete, &DeletePayload{
+		RoomId:    deleted.RoomId,
+		MessageId: deleted.Id.Hex(),
+		DeletedBy: deleted.DeletedBy,
+	})
+}
+
+func (cl *Client) handleReaction(hub *Hub, envelope *Envelope) {
+	var payload ReactionPayload
+	if err := envelope.Decode(&payload); err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, "bad_request", err.Error()))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reactions, changed, err := message.React(ctx, payload.RoomId, payload.MessageId, cl.ID, payload.Emoji, payload.Reacted)
+	if err != nil {
+		cl.reply(hub, NewErrorEnvelope(envelope.Id, errorCode(err), err.Error()))
+		return
+	}
+	if !changed {
+		return
+	}
+	hub.BroadcastEvent(payload.RoomId, cl.ID, EventReaction, &ReactionPayload{
+		RoomId:    payload.RoomId,
+		MessageId: payload.MessageId,
+		UserId:    cl.ID,
+		Emoji:     payload.Emoji,
+		Reacted:   payload.Reacted,
+		Reactions: reactions,
+	})
+}
 
+func errorCode(err error) string {
+	switch err {
+	case message.ErrInvalidId:
+		return "bad_request"
+	case message.ErrNotFound:
+		return "not_found"
+	case message.ErrForbidden:
+		return "forbidden"
+	case message.ErrNotEditable:
+		return "conflict"
+	case message.ErrInvalidCursor, message.ErrNotARoot, message.ErrInvalidEmoji, message.ErrInvalidAttachment:
+		return "bad_request"
 	}
+	return "internal"
 }
@@ -0,0 +1,207 @@
+package ws
+
+import (
+	"chat-server/models"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// EnvelopeVersion is bumped whenever a payload changes in a way older
+// clients cannot ignore.
+const EnvelopeVersion = 1
+
+const (
+	EventSubscribe    = "subscribe"
+	EventUnsubscribe  = "unsubscribe"
+	EventSubscribed   = "subscribed"
+	EventUnsubscribed = "unsubscribed"
+	EventMessage      = "message"
+	EventTyping       = "typing"
+	EventPresence     = "presence"
+	EventReceipt      = "receipt"
+	EventAck          = "ack"
+	EventSent         = "sent"
+	EventDelivered    = "delivered"
+	EventReplayed     = "replayed"
+	EventThread       = "thread"
+	EventEdit         = "edit"
+	EventReaction     = "reaction"
+	EventDelete       = "delete"
+	EventNotification = "notification"
+	EventError        = "error"
+)
+
+// Envelope is the only shape written to or read from a socket. Id is chosen
+// by whoever sends the frame and is echoed back on errors so a client can
+// match the failure to its request.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+	// batch, when set, is written in order instead of the envelope itself.
+	// A replay goes out as one batch so it takes a single slot in the
+	// send queue however many messages it carries.
+	batch []*Envelope
+}
+
+// SubscribePayload joins or leaves a room. A reconnecting client sets Since
+// to the last message it received to have everything after it replayed
+// before any live event.
+type SubscribePayload struct {
+	RoomId string `json:"room_id"`
+	Since  string `json:"since,omitempty"`
+}
+
+// ReplayedPayload follows the replayed messages. HasMore means the gap was
+// longer than one replay and the rest must be loaded from history.
+type ReplayedPayload struct {
+	RoomId  string `json:"room_id"`
+	Count   int    `json:"count"`
+	HasMore bool   `json:"has_more"`
+}
+
+// SendMessagePayload is a new message from a client. ClientId is any
+// string unique to the sender within the room; resending with the same one
+// does not create a second message. ReplyTo quotes another message of the
+// room; ThreadId posts the message in the thread under that root instead of
+// the room timeline.
+type SendMessagePayload struct {
+	RoomId   string `json:"room_id"`
+	Content  string `json:"content"`
+	ClientId string `json:"client_id,omitempty"`
+	ReplyTo  string `json:"reply_to,omitempty"`
+	ThreadId string `json:"thread_id,omitempty"`
+	// AttachmentIds are uploads from UploadAttachment to send along; with
+	// them Content may be empty.
+	AttachmentIds []string `json:"attachment_ids,omitempty"`
+}
+
+// ThreadPayload carries a new thread reply and the root's updated counters.
+type ThreadPayload struct {
+	RoomId      string          `json:"room_id"`
+	ThreadId    string          `json:"thread_id"`
+	ReplyCount  int             `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time      `json:"last_reply_at,omitempty"`
+	Message     *models.Message `json:"message"`
+}
+
+// SentPayload confirms a send to the sender, pairing the client's ID with
+// the stored message.
+type SentPayload struct {
+	RoomId    string    `json:"room_id"`
+	ClientId  string    `json:"client_id,omitempty"`
+	MessageId string    `json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TypingPayload struct {
+	RoomId   string `json:"room_id"`
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+// PresencePayload is what contacts see of a user. Idle is set when Status
+// was switched to away automatically rather than by the user.
+type PresencePayload struct {
+	UserId     string     `json:"user_id"`
+	Online     bool       `json:"online"`
+	Status     string     `json:"status,omitempty"`
+	StatusText string     `json:"status_text,omitempty"`
+	Idle       bool       `json:"idle,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+}
+
+type ReceiptPayload struct {
+	RoomId    string    `json:"room_id"`
+	UserId    string    `json:"user_id"`
+	MessageId string    `json:"message_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// AckPayload is sent by a client for each message it received.
+type AckPayload struct {
+	RoomId    string `json:"room_id"`
+	MessageId string `json:"message_id"`
+}
+
+type DeliveredPayload struct {
+	RoomId      string    `json:"room_id"`
+	UserId      string    `json:"user_id"`
+	MessageId   string    `json:"message_id"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+type EditPayload struct {
+	RoomId    string     `json:"room_id"`
+	MessageId string     `json:"message_id"`
+	Content   string     `json:"content"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+// ReactionPayload adds (Reacted true) or removes one user's reaction. The
+// server answers with Reactions holding the message's full reaction list.
+type ReactionPayload struct {
+	RoomId    string            `json:"room_id"`
+	MessageId string            `json:"message_id"`
+	UserId    string            `json:"user_id,omitempty"`
+	Emoji     string            `json:"emoji"`
+	Reacted   bool              `json:"reacted"`
+	Reactions []models.Reaction `json:"reactions,omitempty"`
+}
+
+type DeletePayload struct {
+	RoomId    string `json:"room_id"`
+	MessageId string `json:"message_id"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+}
+
+type Notification struct {
+	RoomId   string `json:"room_id"`
+	UserId   string `json:"user_id"`
+	Content  string `json:"content"`
+	Username string `json:"username"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewEnvelope(eventType string, payload interface{}) *Envelope {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		data, _ = json.Marshal(&ErrorPayload{Code: "internal", Message: err.Error()})
+		eventType = EventError
+	}
+	return &Envelope{Version: EnvelopeVersion, Type: eventType, Payload: data}
+}
+
+func NewErrorEnvelope(id, code, message string) *Envelope {
+	envelope := NewEnvelope(EventError, &ErrorPayload{Code: code, Message: message})
+	envelope.Id = id
+	return envelope
+}
+
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, errors.New("frame is not a valid envelope")
+	}
+	if envelope.Type == "" {
+		return nil, errors.New("envelope type is required")
+	}
+	if envelope.Version > EnvelopeVersion {
+		return nil, errors.New("unsupported envelope version")
+	}
+	return &envelope, nil
+}
+
+func (e *Envelope) Decode(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("missing payload")
+	}
+	return json.Unmarshal(e.Payload, v)
+}
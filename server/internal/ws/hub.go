@@ -3,82 +3,463 @@ package ws
 import (
 	"chat-server/models"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// typingTimeout is how long a typing indicator lasts without a refresh from
+// the client before the hub clears it itself.
+const typingTimeout = 6 * time.Second
+
+// presenceHeartbeat is how often a node repeats the presence of its users
+// to the other nodes.
+const presenceHeartbeat = 30 * time.Second
+
+// Hub owns every room and connection on this server instance. rooms, users
+// and typing are only touched by the Run goroutine; everything else talks to
+// it through the channels below or the locked read-only methods. When a
+// Backplane is configured, the hub also passes room events, membership and
+// presence to the hubs on other instances.
 type Hub struct {
-	Rooms      map[string]*Room
-	Register   chan *Client
-	Unregister chan *Client
-	Broadcast  chan *models.Message
+	Register    chan *Client
+	Unregister  chan *Client
+	Subscribe   chan *Subscription
+	Unsubscribe chan *Subscription
+	Broadcast   chan *RoomEvent
+	Direct      chan *DirectEvent
+	Membership  chan *MembershipUpdate
+	Typing      chan *TypingPayload
+	Status      chan *StatusUpdate
+	Replay      chan *Replay
+
+	config Config
+	// node identifies this instance on the backplane.
+	node   string
+	outbox chan []byte
+	remote chan *busEvent
+	rooms  map[string]*Room
+	// users holds every open connection of each user on this node.
+	users map[string]map[*Client]bool
+	// announced is the presence last sent to each online user's contacts,
+	// merged across nodes. mu guards it so other goroutines can ask who is
+	// online. Run is the only writer.
+	mu        sync.RWMutex
+	announced map[string]PresencePayload
+	// statuses holds the status each user connected here picked.
+	statuses map[string]StatusUpdate
+	// nodes holds each online user's presence as reported by every node
+	// they are connected to, this one included.
+	nodes     map[string]map[string]nodeEntry
+	heartbeat time.Time
+	// typing maps a room to the users typing in it and when each indicator
+	// expires.
+	typing map[string]map[string]time.Time
+}
+
+// Subscription attaches a connected client to a room. Members is the
+// conversation's participant list at the time the client subscribed. With
+// Replay set, live events for the room are held back until the matching
+// Replay arrives.
+type Subscription struct {
+	Client  *Client
+	RoomId  string
+	Members []models.Participant
+	Replay  bool
+}
+
+// RoomEvent is delivered to every client subscribed to a room, except the
+// sender when SkipSender is set. When Notification is set it is also pushed
+// to every other member who is online but not currently subscribed to the
+// room. MessageId is set for new messages so a replay can skip duplicates.
+// Recipients, when set, also receive the event on devices that are not
+// subscribed to the room.
+type RoomEvent struct {
+	RoomId       string
+	SenderId     string
+	MessageId    string
+	Recipients   []string
+	SkipSender   bool
+	Envelope     *Envelope
+	Notification *Notification
+}
+
+// DirectEvent is delivered to a single client, typically a reply to a frame
+// it sent.
+type DirectEvent struct {
+	Client   *Client
+	Envelope *Envelope
 }
 
-var OnlineUsers = make(map[string]*websocket.Conn)
+// MembershipUpdate replaces the member list of a room after participants are
+// added to or removed from its conversation.
+type MembershipUpdate struct {
+	RoomId  string
+	Members []models.Participant
+}
 
 func NewHub() *Hub {
+	return NewHubWithConfig(ConfigFromEnv())
+}
+
+func NewHubWithConfig(config Config) *Hub {
 	return &Hub{
-		Rooms:      make(map[string]*Room),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan *models.Message),
+		config:      config,
+		node:        primitive.NewObjectID().Hex(),
+		outbox:      make(chan []byte, 4096),
+		remote:      make(chan *busEvent),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Subscribe:   make(chan *Subscription),
+		Unsubscribe: make(chan *Subscription),
+		Broadcast:   make(chan *RoomEvent),
+		Direct:      make(chan *DirectEvent),
+		Membership:  make(chan *MembershipUpdate),
+		Typing:      make(chan *TypingPayload),
+		Status:      make(chan *StatusUpdate),
+		Replay:      make(chan *Replay),
+		rooms:       make(map[string]*Room),
+		users:       make(map[string]map[*Client]bool),
+		announced:   make(map[string]PresencePayload),
+		statuses:    make(map[string]StatusUpdate),
+		nodes:       make(map[string]map[string]nodeEntry),
+		typing:      make(map[string]map[string]time.Time),
 	}
 }
 
-type Notification struct {
-	UserId   string `json:"user_id"`
-	Content  string `json:"content"`
-	Username string `json:"username"`
-	Type     string `json:"type"` // "message" or "notification"
+func (h *Hub) BroadcastMessage(message *models.Message) {
+	content := message.Content
+	if content == "" && len(message.Attachments) > 0 {
+		content = "📎 " + message.Attachments[0].Name
+	}
+	h.Broadcast <- &RoomEvent{
+		RoomId:    message.RoomId,
+		SenderId:  message.UserId,
+		MessageId: message.Id.Hex(),
+		Envelope:  NewEnvelope(EventMessage, message),
+		Notification: &Notification{
+			RoomId:   message.RoomId,
+			UserId:   message.UserId,
+			Content:  content,
+			Username: message.Username,
+		},
+	}
+}
+
+// BroadcastThreadReply sends a thread reply to the room and to every thread
+// participant, wherever they are.
+func (h *Hub) BroadcastThreadReply(reply *models.Message, root *models.Message, participants []string) {
+	h.Broadcast <- &RoomEvent{
+		RoomId:     reply.RoomId,
+		SenderId:   reply.UserId,
+		MessageId:  reply.Id.Hex(),
+		Recipients: participants,
+		Envelope: NewEnvelope(EventThread, &ThreadPayload{
+			RoomId:      reply.RoomId,
+			ThreadId:    reply.ThreadId,
+			ReplyCount:  root.ReplyCount,
+			LastReplyAt: root.LastReplyAt,
+			Message:     reply,
+		}),
+	}
+}
+
+func (h *Hub) BroadcastEvent(roomId, senderId, eventType string, payload interface{}) {
+	h.Broadcast <- &RoomEvent{
+		RoomId:   roomId,
+		SenderId: senderId,
+		Envelope: NewEnvelope(eventType, payload),
+	}
 }
 
 func (h *Hub) Run() {
+	if h.config.Backplane != nil {
+		log.Println("Hub", h.node, "joining backplane")
+		go h.relay()
+		go h.listen()
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case client := <-h.Register:
-			room, exists := h.Rooms[client.RoomId]
-			fmt.Println("Client joined room", client.ID)
-			if !exists {
-				continue
+			fmt.Println("Client connected", client.ID)
+			devices := h.users[client.ID]
+			if devices == nil {
+				devices = make(map[*Client]bool)
+				h.users[client.ID] = devices
 			}
-			_, exists = room.Clients[client.ID]
-			if exists {
-				continue
+			devices[client] = true
+			if len(devices) == 1 {
+				h.statuses[client.ID] = client.status
 			}
-			room.Clients[client.ID] = client
+			h.sendContactPresence(client)
+			h.refreshPresence(client.ID, time.Now())
 		case client := <-h.Unregister:
-			room, exists := h.Rooms[client.RoomId]
-			if !exists {
+			h.drop(client)
+		case sub := <-h.Subscribe:
+			if !h.connected(sub.Client) {
 				continue
 			}
-			_, exists = room.Clients[client.ID]
+			room, exists := h.rooms[sub.RoomId]
 			if !exists {
+				room = &Room{
+					ID:      sub.RoomId,
+					Clients: make(map[*Client]bool),
+				}
+				h.rooms[sub.RoomId] = room
+			}
+			room.Members = memberSet(sub.Members)
+			room.Clients[sub.Client] = true
+			sub.Client.rooms[sub.RoomId] = true
+			if sub.Replay {
+				sub.Client.replaying[sub.RoomId] = []*RoomEvent{}
+			}
+			h.send(sub.Client, NewEnvelope(EventSubscribed, &SubscribePayload{RoomId: sub.RoomId}))
+		case sub := <-h.Unsubscribe:
+			if !h.connected(sub.Client) {
+				continue
+			}
+			h.leaveRoom(sub.Client, sub.RoomId)
+		case update := <-h.Membership:
+			h.updateMembership(update)
+			h.publish(&busEvent{Membership: update})
+		case direct := <-h.Direct:
+			if !h.connected(direct.Client) {
 				continue
 			}
-			delete(h.Rooms[client.RoomId].Clients, client.ID)
-			close(client.Message)
-		case message := <-h.Broadcast:
-			for _, room := range Rooms {
-				if room.ID == message.RoomId {
-					for _, client := range room.Clients {
-						client.Message <- message
-						if client.ID != message.UserId {
-							exists := OnlineUsers[client.ID]
-							if exists != nil {
-								conn := OnlineUsers[client.ID]
-								conn.WriteJSON(&Notification{
-									UserId:   message.UserId,
-									Content:  message.Content,
-									Username: message.Username,
-									Type:     "notification",
-								})
-							}
-						}
-					}
+			h.send(direct.Client, direct.Envelope)
+		case event := <-h.Broadcast:
+			h.broadcast(event)
+		case event := <-h.remote:
+			h.receive(event)
+		case typing := <-h.Typing:
+			h.setTyping(typing)
+		case status := <-h.Status:
+			h.setStatus(status)
+			h.publish(&busEvent{Status: status})
+		case replay := <-h.Replay:
+			h.finishReplay(replay)
+		case now := <-ticker.C:
+			h.expireTyping(now)
+			h.sweepPresence(now)
+		}
+	}
+}
+
+func (h *Hub) updateMembership(update *MembershipUpdate) {
+	members := memberSet(update.Members)
+	h.addContacts(members)
+	// Rooms nobody here is subscribed to get their members on subscribe.
+	room, exists := h.rooms[update.RoomId]
+	if !exists {
+		return
+	}
+	room.Members = members
+	for client := range room.Clients {
+		if !room.Members[client.ID] {
+			h.leaveRoom(client, room.ID)
+		}
+	}
+}
+
+// addContacts makes the members of a room contacts of each other on every
+// connection here, and tells each one who of the others is online. Contacts
+// are not removed, since users who stop sharing this room may share another.
+func (h *Hub) addContacts(members map[string]bool) {
+	for userId := range members {
+		for client := range h.users[userId] {
+			known := make(map[string]bool, len(client.Contacts))
+			for _, contactId := range client.Contacts {
+				known[contactId] = true
+			}
+			for contactId := range members {
+				if contactId == userId || known[contactId] {
+					continue
+				}
+				client.Contacts = append(client.Contacts, contactId)
+				h.mu.RLock()
+				presence, announced := h.announced[contactId]
+				h.mu.RUnlock()
+				if announced && presence.Online {
+					h.send(client, NewEnvelope(EventPresence, &presence))
 				}
+			}
+		}
+		if entry, exists := h.nodes[userId][h.node]; exists {
+			entry.contacts = h.userContacts(userId)
+			h.nodes[userId][h.node] = entry
+		}
+	}
+}
+
+// broadcast delivers an event raised on this node and passes it on to the
+// other nodes.
+func (h *Hub) broadcast(event *RoomEvent) {
+	h.deliver(event, nil)
+	if h.config.Backplane == nil {
+		return
+	}
+	forward := &roomBroadcast{RoomEvent: *event}
+	if room, exists := h.rooms[event.RoomId]; exists && event.Notification != nil {
+		for memberId := range room.Members {
+			forward.Members = append(forward.Members, memberId)
+		}
+	}
+	h.publish(&busEvent{Room: forward})
+}
 
+// deliver sends an event to the local clients of a room. members is used for
+// notifications when no local client has subscribed to the room yet.
+func (h *Hub) deliver(event *RoomEvent, members map[string]bool) {
+	room, exists := h.rooms[event.RoomId]
+	if exists {
+		members = room.Members
+		for client := range room.Clients {
+			if event.SkipSender && client.ID == event.SenderId {
+				continue
+			}
+			if held, replaying := client.replaying[event.RoomId]; replaying {
+				client.replaying[event.RoomId] = append(held, event)
+				continue
+			}
+			h.send(client, event.Envelope)
+		}
+	}
+	for _, recipientId := range event.Recipients {
+		for client := range h.users[recipientId] {
+			if !exists || !room.Clients[client] {
+				h.send(client, event.Envelope)
+			}
+		}
+	}
+	if event.Notification == nil {
+		return
+	}
+	// Devices that are not looking at the room get a notification instead.
+	notification := NewEnvelope(EventNotification, event.Notification)
+	for memberId := range members {
+		if memberId == event.SenderId {
+			continue
+		}
+		for client := range h.users[memberId] {
+			if !exists || !room.Clients[client] {
+				h.send(client, notification)
 			}
+		}
+	}
+}
 
+// setTyping records a typing start or stop and relays it to the rest of the
+// room. Repeated starts only push the expiry back, so clients can refresh
+// the indicator every few seconds without flooding the room.
+func (h *Hub) setTyping(typing *TypingPayload) {
+	users := h.typing[typing.RoomId]
+	_, wasTyping := users[typing.UserId]
+	if typing.Typing {
+		if users == nil {
+			users = make(map[string]time.Time)
+			h.typing[typing.RoomId] = users
+		}
+		users[typing.UserId] = time.Now().Add(typingTimeout)
+		if wasTyping {
+			return
+		}
+	} else {
+		if !wasTyping {
+			return
+		}
+		delete(users, typing.UserId)
+		if len(users) == 0 {
+			delete(h.typing, typing.RoomId)
+		}
+	}
+	h.broadcast(&RoomEvent{
+		RoomId:     typing.RoomId,
+		SenderId:   typing.UserId,
+		SkipSender: true,
+		Envelope:   NewEnvelope(EventTyping, typing),
+	})
+}
+
+func (h *Hub) expireTyping(now time.Time) {
+	for roomId, users := range h.typing {
+		for userId, expires := range users {
+			if now.After(expires) {
+				h.setTyping(&TypingPayload{RoomId: roomId, UserId: userId, Typing: false})
+			}
+		}
+	}
+}
+
+func (h *Hub) stopTyping(client *Client, roomId string) {
+	if _, typing := h.typing[roomId][client.ID]; typing {
+		h.setTyping(&TypingPayload{RoomId: roomId, UserId: client.ID, Username: client.Username, Typing: false})
+	}
+}
+
+func (h *Hub) leaveRoom(client *Client, roomId string) {
+	h.stopTyping(client, roomId)
+	delete(client.rooms, roomId)
+	delete(client.replaying, roomId)
+	room, exists := h.rooms[roomId]
+	if !exists || !room.Clients[client] {
+		return
+	}
+	delete(room.Clients, client)
+	if len(room.Clients) == 0 {
+		delete(h.rooms, roomId)
+	}
+	h.send(client, NewEnvelope(EventUnsubscribed, &SubscribePayload{RoomId: roomId}))
+}
+
+func (h *Hub) connected(client *Client) bool {
+	return h.users[client.ID][client]
+}
+
+// drop disconnects a client. When it was the user's last connection on any
+// node the user goes offline: contacts are told and last_seen is stored,
+// unless the user was invisible and already looked offline.
+func (h *Hub) drop(client *Client) {
+	if client.closed || !h.connected(client) {
+		return
+	}
+	h.disconnect(client)
+	if len(h.users[client.ID]) > 0 {
+		return
+	}
+	delete(h.users, client.ID)
+	delete(h.statuses, client.ID)
+	offline := PresencePayload{UserId: client.ID}
+	visible := h.nodes[client.ID][h.node].presence.Online
+	if visible {
+		lastSeen := time.Now()
+		offline.LastSeen = &lastSeen
+	}
+	h.publishPresence(client.ID, client.Contacts, offline)
+	if visible && !h.announced[client.ID].Online {
+		go recordLastSeen(client.ID, *offline.LastSeen)
+	}
+}
+
+func (h *Hub) disconnect(client *Client) {
+	if client.closed {
+		return
+	}
+	client.closed = true
+	for roomId := range client.rooms {
+		h.stopTyping(client, roomId)
+		room, exists := h.rooms[roomId]
+		if !exists {
+			continue
+		}
+		delete(room.Clients, client)
+		if len(room.Clients) == 0 {
+			delete(h.rooms, roomId)
 		}
 	}
+	delete(h.users[client.ID], client)
+	close(client.Message)
 }
@@ -0,0 +1,211 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestClient builds a client with no socket; tests read its Message
+// channel directly.
+func newTestClient(h *Hub, id string, contacts []string) *Client {
+	client := &Client{
+		ID:        id,
+		Username:  id,
+		Message:   make(chan *Envelope, h.config.SendBuffer),
+		Contacts:  contacts,
+		rooms:     make(map[string]bool),
+		replaying: make(map[string][]*RoomEvent),
+		status:    StatusUpdate{UserId: id, Status: models.StatusAvailable},
+		wake:      make(chan struct{}, 1),
+	}
+	client.lastActive.Store(time.Now().UnixNano())
+	return client
+}
+
+// drain plays the part of writePump until the hub closes the client.
+func drain(client *Client, slow bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case _, ok := <-client.Message:
+			if !ok {
+				return
+			}
+			if slow {
+				time.Sleep(time.Millisecond)
+			}
+		case <-client.wake:
+			client.takeBacklog()
+		}
+	}
+}
+
+// expect waits for an event of the given type, skipping anything else.
+func expect(t *testing.T, client *Client, eventType string, match func(json.RawMessage) bool) {
+	t.Helper()
+	deadline := time.After(3 * time.Second)
+	for {
+		select {
+		case envelope := <-client.Message:
+			if envelope.Type == eventType && (match == nil || match(envelope.Payload)) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("%s got no %s event", client.ID, eventType)
+		}
+	}
+}
+
+func presenceOf(userId string, online bool) func(json.RawMessage) bool {
+	return func(data json.RawMessage) bool {
+		var presence PresencePayload
+		return json.Unmarshal(data, &presence) == nil && presence.UserId == userId && presence.Online == online
+	}
+}
+
+// TestHubConcurrent joins, leaves and broadcasts from many goroutines at
+// once under every overflow policy. Run it with -race.
+func TestHubConcurrent(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowDisconnect, OverflowSpill} {
+		t.Run(string(policy), func(t *testing.T) {
+			h := NewHubWithConfig(Config{SendBuffer: 4, Overflow: policy, SpillLimit: 50, AwayAfter: time.Minute})
+			go h.Run()
+			var members []models.Participant
+			for i := 0; i < 20; i++ {
+				members = append(members, models.Participant{Id: fmt.Sprint("u", i)})
+			}
+			var senders, drains sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				senders.Add(1)
+				go func(i int) {
+					defer senders.Done()
+					for round := 0; round < 20; round++ {
+						client := newTestClient(h, fmt.Sprint("u", i), []string{"u0", "u1"})
+						drains.Add(1)
+						go drain(client, i%5 == 0, &drains)
+						h.Register <- client
+						h.Subscribe <- &Subscription{Client: client, RoomId: "r", Members: members}
+						h.Typing <- &TypingPayload{RoomId: "r", UserId: client.ID, Typing: true}
+						h.BroadcastMessage(&models.Message{RoomId: "r", UserId: client.ID, Content: "hi"})
+						h.Direct <- &DirectEvent{Client: client, Envelope: NewErrorEnvelope("1", "test", "direct")}
+						h.Presence("u3")
+						if round%3 == 0 {
+							h.Membership <- &MembershipUpdate{RoomId: "r", Members: members[:10]}
+							h.Membership <- &MembershipUpdate{RoomId: "r", Members: members}
+						}
+						h.Unsubscribe <- &Subscription{Client: client, RoomId: "r"}
+						h.Unregister <- client
+					}
+				}(i)
+			}
+			senders.Wait()
+			drains.Wait()
+			// The hub takes the next event only once the last leave is done.
+			h.Typing <- &TypingPayload{RoomId: "r", UserId: "u0"}
+			for i := 0; i < 20; i++ {
+				if _, online := h.Presence(fmt.Sprint("u", i)); online {
+					t.Fatalf("u%d still online after every connection left", i)
+				}
+			}
+		})
+	}
+}
+
+// TestHubMembership checks that membership changes leave no room behind
+// when nobody here is subscribed, and that new members see each other.
+func TestHubMembership(t *testing.T) {
+	h := NewHubWithConfig(DefaultConfig())
+	go h.Run()
+	x := newTestClient(h, "x", nil)
+	y := newTestClient(h, "y", nil)
+	h.Register <- x
+	h.Register <- y
+	members := []models.Participant{{Id: "x"}, {Id: "y"}}
+	h.Membership <- &MembershipUpdate{RoomId: "group", Members: members}
+	expect(t, x, EventPresence, presenceOf("y", true))
+	expect(t, y, EventPresence, presenceOf("x", true))
+
+	h.Subscribe <- &Subscription{Client: x, RoomId: "group", Members: members}
+	expect(t, x, EventSubscribed, nil)
+	h.Unsubscribe <- &Subscription{Client: x, RoomId: "group"}
+	expect(t, x, EventUnsubscribed, nil)
+	h.Membership <- &MembershipUpdate{RoomId: "group", Members: members[:1]}
+	// The hub takes the next event only once the update is done.
+	h.Typing <- &TypingPayload{RoomId: "group", UserId: "x"}
+	if len(h.rooms) != 0 {
+		t.Fatalf("%d rooms kept without subscribers", len(h.rooms))
+	}
+}
+
+// TestHubReplay replays far more messages than the send queue holds and
+// checks the client stays connected and gets them, the replayed marker and
+// the held live events in order, without the ones the replay covered.
+func TestHubReplay(t *testing.T) {
+	config := DefaultConfig()
+	config.SendBuffer = 4
+	h := NewHubWithConfig(config)
+	go h.Run()
+	x := newTestClient(h, "x", nil)
+	h.Register <- x
+	members := []models.Participant{{Id: "x"}, {Id: "y"}}
+	h.Subscribe <- &Subscription{Client: x, RoomId: "r", Members: members, Replay: true}
+	expect(t, x, EventSubscribed, nil)
+
+	var missed []models.Message
+	for i := 0; i < 300; i++ {
+		missed = append(missed, models.Message{Id: primitive.NewObjectID(), RoomId: "r", UserId: "y"})
+	}
+	var live []string
+	for i := 0; i < 10; i++ {
+		msg := &models.Message{Id: primitive.NewObjectID(), RoomId: "r", UserId: "y"}
+		if i < 2 {
+			msg = &missed[len(missed)-2+i]
+		} else {
+			live = append(live, msg.Id.Hex())
+		}
+		h.BroadcastMessage(msg)
+	}
+	h.Replay <- &Replay{Client: x, Id: "1", RoomId: "r", Messages: missed}
+
+	var ids []string
+	select {
+	case envelope := <-x.Message:
+		if envelope.batch == nil {
+			t.Fatalf("got %s instead of the replay", envelope.Type)
+		}
+		for _, item := range envelope.batch {
+			if item.Type == EventReplayed {
+				ids = append(ids, EventReplayed)
+				continue
+			}
+			var msg models.Message
+			if err := json.Unmarshal(item.Payload, &msg); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, msg.Id.Hex())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("replay never arrived")
+	}
+	var want []string
+	for _, msg := range missed {
+		want = append(want, msg.Id.Hex())
+	}
+	want = append(want, EventReplayed)
+	want = append(want, live...)
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Fatalf("replay sent %d events out of order, want %d", len(ids), len(want))
+	}
+	// The hub takes the next event only once the replay is done.
+	h.Typing <- &TypingPayload{RoomId: "r", UserId: "x"}
+	if !h.connected(x) {
+		t.Fatal("client dropped by the replay")
+	}
+}
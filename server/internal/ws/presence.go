@@ -0,0 +1,286 @@
+package ws
+
+import (
+	"chat-server/models"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// StatusUpdate carries a status the user picked. Status is one of the
+// models.Status* values; Text is cleared once ExpiresAt passes.
+type StatusUpdate struct {
+	UserId    string
+	Status    string
+	Text      string
+	ExpiresAt *time.Time
+}
+
+type UpdateStatusReq struct {
+	Status    string `json:"status" binding:"required"`
+	Text      string `json:"text"`
+	ExpiresIn int    `json:"expires_in"` // seconds, 0 keeps the text until changed
+}
+
+var validStatuses = map[string]bool{
+	models.StatusAvailable:    true,
+	models.StatusAway:         true,
+	models.StatusDoNotDisturb: true,
+	models.StatusInvisible:    true,
+}
+
+// statusOf reads the stored status of a user, dropping an expired text.
+func statusOf(user *models.User, now time.Time) StatusUpdate {
+	status := StatusUpdate{
+		UserId:    user.UserId,
+		Status:    user.Status,
+		Text:      user.StatusText,
+		ExpiresAt: user.StatusExpiresAt,
+	}
+	if status.Status == "" {
+		status.Status = models.StatusAvailable
+	}
+	return status.expire(now)
+}
+
+func (s StatusUpdate) expire(now time.Time) StatusUpdate {
+	if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+		s.Text = ""
+		s.ExpiresAt = nil
+	}
+	return s
+}
+
+// lastActive is the most recent frame received from any of the user's
+// connections.
+func (h *Hub) lastActive(userId string) time.Time {
+	var latest int64
+	for client := range h.users[userId] {
+		if t := client.lastActive.Load(); t > latest {
+			latest = t
+		}
+	}
+	return time.Unix(0, latest)
+}
+
+// presenceOf works out what contacts should see: offline when the user has
+// no connection or is invisible, away when an available user has been idle
+// for longer than AwayAfter, and the chosen status otherwise.
+func (h *Hub) presenceOf(userId string, now time.Time) PresencePayload {
+	status, exists := h.statuses[userId]
+	if len(h.users[userId]) == 0 || !exists || status.Status == models.StatusInvisible {
+		return PresencePayload{UserId: userId}
+	}
+	presence := PresencePayload{
+		UserId:     userId,
+		Online:     true,
+		Status:     status.Status,
+		StatusText: status.Text,
+	}
+	if status.Status == models.StatusAvailable && now.Sub(h.lastActive(userId)) > h.config.AwayAfter {
+		presence.Status = models.StatusAway
+		presence.Idle = true
+	}
+	return presence
+}
+
+// userContacts returns the contact list of any of the user's connections;
+// they were all loaded from the same conversations.
+func (h *Hub) userContacts(userId string) []string {
+	for client := range h.users[userId] {
+		return client.Contacts
+	}
+	return nil
+}
+
+// statusRanks orders the states a user can be in on one node; the best one
+// across nodes wins.
+var statusRanks = map[string]int{
+	models.StatusAway:         1,
+	models.StatusDoNotDisturb: 2,
+	models.StatusAvailable:    3,
+}
+
+// nodeEntry is a user's presence on one node. Entries from other nodes
+// expire unless the node repeats them, so a node that dies does not leave
+// its users online forever.
+type nodeEntry struct {
+	presence PresencePayload
+	contacts []string
+	expires  time.Time
+}
+
+// refreshPresence recomputes a user's presence on this node and shares it
+// if it changed.
+func (h *Hub) refreshPresence(userId string, now time.Time) {
+	presence := h.presenceOf(userId, now)
+	previous := PresencePayload{UserId: userId}
+	if entry, exists := h.nodes[userId][h.node]; exists {
+		previous = entry.presence
+	}
+	if previous == presence {
+		return
+	}
+	h.publishPresence(userId, h.userContacts(userId), presence)
+}
+
+func (h *Hub) publishPresence(userId string, contacts []string, presence PresencePayload) {
+	h.setNodePresence(h.node, presence, contacts, time.Time{})
+	h.publish(&busEvent{Presence: &nodePresence{Contacts: contacts, Presence: presence}})
+}
+
+// setNodePresence records a user's presence on one node and tells the
+// user's contacts connected here if the merged presence changed. A user is
+// offline once no node reports them online.
+func (h *Hub) setNodePresence(node string, presence PresencePayload, contacts []string, expires time.Time) {
+	userId := presence.UserId
+	entries := h.nodes[userId]
+	if presence.Online {
+		if entries == nil {
+			entries = make(map[string]nodeEntry)
+			h.nodes[userId] = entries
+		}
+		entries[node] = nodeEntry{presence: presence, contacts: contacts, expires: expires}
+	} else {
+		delete(entries, node)
+		if len(entries) == 0 {
+			delete(h.nodes, userId)
+		}
+	}
+	merged := presence
+	for _, entry := range entries {
+		if !merged.Online || statusRanks[entry.presence.Status] > statusRanks[merged.Status] {
+			merged = entry.presence
+		}
+	}
+	h.mu.RLock()
+	previous := h.announced[userId]
+	h.mu.RUnlock()
+	if previous == merged || !previous.Online && !merged.Online {
+		return
+	}
+	h.mu.Lock()
+	if merged.Online {
+		h.announced[userId] = merged
+	} else {
+		delete(h.announced, userId)
+	}
+	h.mu.Unlock()
+	h.broadcastPresence(userId, contacts, &merged)
+}
+
+// setStatus applies a status the user picked and echoes it to the user's
+// own connections, which see their real status even when invisible.
+func (h *Hub) setStatus(update *StatusUpdate) {
+	if len(h.users[update.UserId]) == 0 {
+		return
+	}
+	h.statuses[update.UserId] = update.expire(time.Now())
+	own := NewEnvelope(EventPresence, &PresencePayload{
+		UserId:     update.UserId,
+		Online:     true,
+		Status:     update.Status,
+		StatusText: update.Text,
+	})
+	for client := range h.users[update.UserId] {
+		h.send(client, own)
+	}
+	h.refreshPresence(update.UserId, time.Now())
+}
+
+// sweepPresence expires status texts, flips idle users to away and back,
+// repeats this node's presence to the others every presenceHeartbeat and
+// drops entries other nodes stopped repeating.
+func (h *Hub) sweepPresence(now time.Time) {
+	for userId, status := range h.statuses {
+		h.statuses[userId] = status.expire(now)
+		h.refreshPresence(userId, now)
+	}
+	if h.config.Backplane == nil {
+		return
+	}
+	if now.Sub(h.heartbeat) >= presenceHeartbeat {
+		h.heartbeat = now
+		for userId := range h.statuses {
+			if entry, exists := h.nodes[userId][h.node]; exists {
+				h.publish(&busEvent{Presence: &nodePresence{Contacts: entry.contacts, Presence: entry.presence}})
+			}
+		}
+	}
+	for userId, entries := range h.nodes {
+		for node, entry := range entries {
+			if node != h.node && now.After(entry.expires) {
+				h.setNodePresence(node, PresencePayload{UserId: userId}, entry.contacts, time.Time{})
+			}
+		}
+	}
+}
+
+// broadcastPresence sends a presence change to every connection of the
+// given contacts on this node.
+func (h *Hub) broadcastPresence(userId string, contacts []string, presence *PresencePayload) {
+	envelope := NewEnvelope(EventPresence, presence)
+	for _, contactId := range contacts {
+		for contact := range h.users[contactId] {
+			h.send(contact, envelope)
+		}
+	}
+}
+
+// sendContactPresence tells a new connection which of its contacts are
+// visibly online.
+func (h *Hub) sendContactPresence(client *Client) {
+	for _, contactId := range client.Contacts {
+		h.mu.RLock()
+		presence, announced := h.announced[contactId]
+		h.mu.RUnlock()
+		if announced && presence.Online {
+			h.send(client, NewEnvelope(EventPresence, &presence))
+		}
+	}
+}
+
+// Presence returns what other users currently see for userId. It is safe
+// to call from any goroutine.
+func (h *Hub) Presence(userId string) (PresencePayload, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	presence, announced := h.announced[userId]
+	return presence, announced && presence.Online
+}
+
+func (h *Hub) UpdateStatus(c *gin.Context) {
+	userId := c.GetString("user_id")
+	var req UpdateStatusReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "message": err.Error()})
+		return
+	}
+	if !validStatuses[req.Status] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be available, away, dnd or invisible"})
+		return
+	}
+	update := &StatusUpdate{UserId: userId, Status: req.Status, Text: req.Text}
+	if req.ExpiresIn > 0 && req.Text != "" {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		update.ExpiresAt = &expiresAt
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := UserCollection.UpdateOne(ctx, bson.M{"user_id": userId}, bson.M{"$set": bson.M{
+		"status":            update.Status,
+		"status_text":       update.Text,
+		"status_expires_at": update.ExpiresAt,
+	}})
+	if err != nil {
+		fmt.Println("Error saving status:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save status", "message": err.Error()})
+		return
+	}
+	h.Status <- update
+	c.JSON(http.StatusOK, gin.H{"message": "Status updated successfully", "data": update})
+}
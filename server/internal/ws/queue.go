@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"chat-server/db"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// OverflowPolicy decides what the hub does when a client's send queue is
+// full.
+type OverflowPolicy string
+
+const (
+	// OverflowDrop discards the event for that client only.
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowDisconnect closes the client, which can reconnect and reload.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+	// OverflowSpill parks events in an unbuffered backlog that the writer
+	// drains after the queue, up to SpillLimit events.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+type Config struct {
+	SendBuffer int
+	Overflow   OverflowPolicy
+	SpillLimit int
+	// AwayAfter is how long an available user may send nothing before
+	// contacts see them as away.
+	AwayAfter time.Duration
+	// Backplane connects this hub to the hubs on other instances. Nil
+	// keeps the hub to itself.
+	Backplane Backplane
+}
+
+func DefaultConfig() Config {
+	return Config{
+		SendBuffer: 256,
+		Overflow:   OverflowDisconnect,
+		SpillLimit: 4096,
+		AwayAfter:  5 * time.Minute,
+	}
+}
+
+// ConfigFromEnv reads WS_SEND_BUFFER, WS_OVERFLOW_POLICY, WS_SPILL_LIMIT,
+// WS_AWAY_AFTER and WS_BACKPLANE, falling back to DefaultConfig for anything
+// unset or invalid. WS_BACKPLANE is "memory" or "mongo"; leave it unset when
+// running a single instance.
+func ConfigFromEnv() Config {
+	cfg := DefaultConfig()
+	switch backplane := os.Getenv("WS_BACKPLANE"); backplane {
+	case "memory":
+		cfg.Backplane = NewMemoryBackplane()
+	case "mongo":
+		cfg.Backplane = NewMongoBackplane(db.MessageData(db.Client, "hub_events"))
+	case "":
+	default:
+		log.Println("Unknown WS_BACKPLANE", backplane, "running without one")
+	}
+	if d, err := time.ParseDuration(os.Getenv("WS_AWAY_AFTER")); err == nil && d > 0 {
+		cfg.AwayAfter = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("WS_SEND_BUFFER")); err == nil && n > 0 {
+		cfg.SendBuffer = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("WS_SPILL_LIMIT")); err == nil && n > 0 {
+		cfg.SpillLimit = n
+	}
+	switch policy := OverflowPolicy(os.Getenv("WS_OVERFLOW_POLICY")); policy {
+	case OverflowDrop, OverflowDisconnect, OverflowSpill:
+		cfg.Overflow = policy
+	case "":
+	default:
+		log.Println("Unknown WS_OVERFLOW_POLICY", policy, "using", cfg.Overflow)
+	}
+	return cfg
+}
+
+// send queues an envelope for a client without ever blocking the hub.
+func (h *Hub) send(client *Client, envelope *Envelope) {
+	if client.closed {
+		return
+	}
+	if client.spilled() == 0 {
+		select {
+		case client.Message <- envelope:
+			return
+		default:
+		}
+	}
+	switch h.config.Overflow {
+	case OverflowDrop:
+		log.Println("Send queue full, dropping", envelope.Type, "for client:", client.ID)
+	case OverflowSpill:
+		if client.spill(envelope) <= h.config.SpillLimit {
+			return
+		}
+		log.Println("Spill limit reached, disconnecting client:", client.ID)
+		h.drop(client)
+	default:
+		log.Println("Send queue full, disconnecting client:", client.ID)
+		h.drop(client)
+	}
+}
+
+// spilled returns how many events are waiting in the backlog.
+func (cl *Client) spilled() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.backlog)
+}
+
+func (cl *Client) spill(envelope *Envelope) int {
+	cl.mu.Lock()
+	cl.backlog = append(cl.backlog, envelope)
+	n := len(cl.backlog)
+	cl.mu.Unlock()
+	select {
+	case cl.wake <- struct{}{}:
+	default:
+	}
+	return n
+}
+
+// takeBacklog empties the backlog. Anything still in the queue is older than
+// the backlog, so the caller must flush the queue first.
+func (cl *Client) takeBacklog() []*Envelope {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	backlog := cl.backlog
+	cl.backlog = nil
+	return backlog
+}
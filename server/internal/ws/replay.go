@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"chat-server/internal/message"
+	"chat-server/models"
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxReplay caps how many missed messages are resent on one subscribe.
+const maxReplay = 500
+
+// Replay carries the messages a client missed in a room, oldest first.
+type Replay struct {
+	Client   *Client
+	Id       string
+	RoomId   string
+	Messages []models.Message
+	HasMore  bool
+	Err      error
+}
+
+// replay loads everything in the room after since and hands it to the hub.
+// The hub is already holding back live events for the room, and anything
+// broadcast was stored first, so between the two nothing is missed.
+func (cl *Client) replay(hub *Hub, id, roomId, since string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	replay := &Replay{Client: cl, Id: id, RoomId: roomId}
+	query := message.PageQuery{After: since, Limit: message.MaxPageSize}
+	for {
+		page, err := message.FindPage(ctx, bson.M{"room_id": roomId}, query)
+		if err != nil {
+			log.Println("Error loading missed messages for client:", cl.ID, err)
+			replay.Err = err
+			break
+		}
+		for i := len(page.Messages) - 1; i >= 0; i-- {
+			replay.Messages = append(replay.Messages, page.Messages[i])
+		}
+		if !page.HasNewer {
+			break
+		}
+		if len(replay.Messages) >= maxReplay {
+			replay.HasMore = true
+			break
+		}
+		query.After = page.PrevCursor
+	}
+	hub.Replay <- replay
+}
+
+// finishReplay sends the missed messages, then the live events held back
+// while they loaded, skipping messages the replay already covered. They go
+// to the writer as one batch, so a long replay cannot overflow the queue.
+func (h *Hub) finishReplay(replay *Replay) {
+	client := replay.Client
+	held, replaying := client.replaying[replay.RoomId]
+	if !h.connected(client) || !replaying {
+		return
+	}
+	delete(client.replaying, replay.RoomId)
+	batch := make([]*Envelope, 0, len(replay.Messages)+len(held)+2)
+	if replay.Err != nil {
+		batch = append(batch, NewErrorEnvelope(replay.Id, errorCode(replay.Err), replay.Err.Error()))
+	}
+	sent := make(map[string]bool, len(replay.Messages))
+	for i := range replay.Messages {
+		msg := &replay.Messages[i]
+		sent[msg.Id.Hex()] = true
+		if msg.ThreadId != "" {
+			batch = append(batch, NewEnvelope(EventThread, &ThreadPayload{RoomId: msg.RoomId, ThreadId: msg.ThreadId, Message: msg}))
+			continue
+		}
+		batch = append(batch, NewEnvelope(EventMessage, msg))
+	}
+	done := NewEnvelope(EventReplayed, &ReplayedPayload{
+		RoomId:  replay.RoomId,
+		Count:   len(replay.Messages),
+		HasMore: replay.HasMore,
+	})
+	done.Id = replay.Id
+	batch = append(batch, done)
+	for _, event := range held {
+		if event.MessageId != "" && sent[event.MessageId] {
+			continue
+		}
+		batch = append(batch, event.Envelope)
+	}
+	h.send(client, &Envelope{Type: EventReplayed, batch: batch})
+}
@@ -6,11 +6,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type CreateRoomReq struct {
@@ -28,93 +30,40 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func EnterApp(c *gin.Context) {
-	userId := c.Query("user_id")
-	fmt.Println("User with ID:", userId, " is entering the app")
-	if userId == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
-		return
-	}
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	fmt.Println("reached here 0")
-	err := UserCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user)
-	if err != nil {
-		fmt.Println("Error finding user:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
-		return
-	}
-	fmt.Println("reached here 1")
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	OnlineUsers[userId] = conn
-
-	if err != nil {
-		fmt.Println("Error upgrading connection:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
-		return
-	}
+// contactsOf returns everyone who shares a conversation with the user, which
+// is the audience for their presence changes.
+func contactsOf(ctx context.Context, userId string) ([]string, error) {
 	cursor, err := ConversationCollection.Find(ctx, bson.M{
 		"participants.id": userId,
 	})
 	if err != nil {
-		fmt.Println("Error fetching conversations:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations"})
-		return
+		return nil, err
 	}
 	defer cursor.Close(ctx)
 	var conversations []models.Conversation
 	if err := cursor.All(ctx, &conversations); err != nil {
-		fmt.Println("Error decoding conversations:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode conversations"})
-		return
-	}
-	type msg struct {
-		UserId string `json:"user_id"`
-		Online bool   `json:"online"`
+		return nil, err
 	}
+	seen := make(map[string]bool)
+	var contacts []string
 	for _, conversation := range conversations {
-		for _, participants := range conversation.Participants {
-			if participants.Id != userId {
-				exists := OnlineUsers[participants.Id]
-				if exists != nil {
-					OtherUserConn := OnlineUsers[participants.Id]
-					OtherUserConn.WriteJSON(&msg{
-						UserId: userId,
-						Online: true,
-					})
-					conn.WriteJSON(&msg{
-						UserId: participants.Id,
-						Online: true,
-					})
-				}
+		for _, participant := range conversation.Participants {
+			if participant.Id != userId && !seen[participant.Id] {
+				seen[participant.Id] = true
+				contacts = append(contacts, participant.Id)
 			}
 		}
 	}
+	return contacts, nil
+}
 
-	var exitMsg msg
-	conn.ReadJSON(&exitMsg)
-	var conversations1 []models.Conversation
-	if err := cursor.All(ctx, &conversations1); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode conversations"})
-		return
-	}
-	for _, conversation := range conversations {
-		for _, participants := range conversation.Participants {
-			if participants.Id != userId {
-				exists := OnlineUsers[participants.Id]
-				if exists != nil {
-					conn := OnlineUsers[participants.Id]
-					conn.WriteJSON(&msg{
-						UserId: userId,
-						Online: false,
-					})
-				}
-			}
-		}
+func recordLastSeen(userId string, lastSeen time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := UserCollection.UpdateOne(ctx, bson.M{"user_id": userId}, bson.M{"$set": bson.M{"last_seen": lastSeen}})
+	if err != nil {
+		fmt.Println("Error recording last seen for user:", userId, err)
 	}
-	delete(OnlineUsers, userId)
-
 }
 
 func getConversationByRoomId(roomId string) (*models.Conversation, error) {
@@ -128,40 +77,86 @@ func getConversationByRoomId(roomId string) (*models.Conversation, error) {
 	return &conversation, nil
 }
 
-func (h *Hub) HandleJoinRoom(c *gin.Context) {
-	roomId := c.Param("room_id")
-	userId := c.Query("user_id")
-	userName := c.Query("username")
-	_, err := getConversationByRoomId(roomId)
+// ServeWs upgrades the single socket a user keeps open for the whole app.
+// The caller is identified by middleware.AuthenticateWs; rooms are joined and
+// left afterwards with subscribe/unsubscribe frames.
+func (h *Hub) ServeWs(c *gin.Context) {
+	userId := c.GetString("user_id")
+	username := c.GetString("username")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	contacts, err := contactsOf(ctx, userId)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		fmt.Println("Error fetching conversations:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations"})
+		return
+	}
+	var user models.User
+	if err := UserCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user); err != nil {
+		fmt.Println("Error fetching user:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
 		return
 	}
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	var responseHeader http.Header
+	if protocol := c.GetString("ws_protocol"); protocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
+		fmt.Println("Error upgrading connection:", err)
 		return
 	}
-	fmt.Print("User joined room:", userId, "Room ID:", roomId, "Username:", userName, "\n")
+	fmt.Println("User with ID:", userId, "connected")
 	client := &Client{
-		ID:       userId,
-		Conn:     conn,
-		Message:  make(chan *models.Message),
-		RoomId:   roomId,
-		Username: userName,
-	}
-	fmt.Println("reached 1")
-	_, exist := Rooms[roomId]
-	if !exist {
-		Rooms[roomId] = &Room{
-			ID:      roomId,
-			Clients: make(map[string]*Client),
-		}
-		fmt.Println("Client coming", client.ID, "in room", roomId)
-		Rooms[roomId].Clients[client.ID] = client
-	} else {
-		Rooms[roomId].Clients[client.ID] = client
+		ID:        userId,
+		Conn:      conn,
+		Message:   make(chan *Envelope, h.config.SendBuffer),
+		Username:  username,
+		Contacts:  contacts,
+		rooms:     make(map[string]bool),
+		replaying: make(map[string][]*RoomEvent),
+		wake:      make(chan struct{}, 1),
+		status:    statusOf(&user, time.Now()),
 	}
+	client.lastActive.Store(time.Now().UnixNano())
 	go client.WriteMessage()
+	h.Register <- client
 	client.ReadMessage(h)
 }
+
+// GetPresence reports the status of each of the comma separated user_ids
+// as their contacts see it and, for those who are offline, when they were
+// last seen. Invisible users are reported as offline.
+func (h *Hub) GetPresence(c *gin.Context) {
+	userIds := strings.Split(c.Query("user_ids"), ",")
+	if c.Query("user_ids") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ids is required"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Find().SetProjection(bson.M{"user_id": 1, "last_seen": 1})
+	cursor, err := UserCollection.Find(ctx, bson.M{"user_id": bson.M{"$in": userIds}}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users", "message": err.Error()})
+		return
+	}
+	defer cursor.Close(ctx)
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode users", "message": err.Error()})
+		return
+	}
+	presence := make([]PresencePayload, 0, len(users))
+	for _, user := range users {
+		entry, online := h.Presence(user.UserId)
+		if !online {
+			entry = PresencePayload{UserId: user.UserId, LastSeen: user.LastSeen}
+		}
+		presence = append(presence, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Presence fetched successfully",
+		"data":    presence,
+	})
+}
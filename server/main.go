@@ -1,8 +1,10 @@
 package main
 
 import (
+	"chat-server/db"
 	"chat-server/internal/ws"
 	"chat-server/routes"
+	"chat-server/tokens"
 	"log"
 	"time"
 
@@ -21,6 +23,10 @@ func main() {
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
+	db.Ping(db.Client)
+	tokens.RequireSecret()
+	db.MergeDirectConversations(db.Client)
+	db.CreateIndexes(db.Client)
 	h := ws.NewHub()
 	go h.Run()
 	routes.ChatRoutes(router, h)
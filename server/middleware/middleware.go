@@ -3,8 +3,10 @@ package middleware
 import (
 	"chat-server/tokens"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 func Authenticate() gin.HandlerFunc {
@@ -28,3 +30,32 @@ func Authenticate() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// AuthenticateWs validates the JWT for a socket upgrade. Browsers cannot set
+// headers on a WebSocket handshake, so the token is read from the "token"
+// query parameter or from the subprotocol list as ["bearer", "<token>"].
+func AuthenticateWs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		protocols := websocket.Subprotocols(c.Request)
+		if len(protocols) >= 2 && strings.EqualFold(protocols[0], "bearer") {
+			token = protocols[1]
+			c.Set("ws_protocol", protocols[0])
+		}
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "message": "No token provided"})
+			c.Abort()
+			return
+		}
+		claims, err := tokens.ValidateToken(token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "message": err.Error()})
+			c.Abort()
+			return
+		}
+		c.Set("user_id", claims.UserId)
+		c.Set("email", claims.Email)
+		c.Set("username", claims.Username)
+		c.Next()
+	}
+}
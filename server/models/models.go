@@ -7,17 +7,32 @@ import (
 )
 
 type User struct {
-	ID          primitive.ObjectID `json:"_id" bson:"_id"`
-	Username    string             `json:"username" bson:"username"`
-	Email       string             `json:"email" bson:"email"`
-	Password    string             `json:"password" bson:"password"`
-	UserId      string             `json:"user_id" bson:"user_id"`
-	Image       string             `json:"image" bson:"image" default:"https://cdn.pixabay.com/photo/2015/10/05/22/37/blank-profile-picture-973460_1280.png"`
-	Otp         string             `json:"otp" bson:"otp"`
-	OtpExpires  time.Time          `json:"otp_expires" bson:"otp_expires"`
-	Verified    bool               `json:"verified" bson:"verified"`
-	GoogleLogin bool               `json:"google_login" bson:"google_login"`
+	ID              primitive.ObjectID `json:"_id" bson:"_id"`
+	Username        string             `json:"username" bson:"username"`
+	Email           string             `json:"email" bson:"email"`
+	Password        string             `json:"password" bson:"password"`
+	UserId          string             `json:"user_id" bson:"user_id"`
+	Image           string             `json:"image" bson:"image" default:"https://cdn.pixabay.com/photo/2015/10/05/22/37/blank-profile-picture-973460_1280.png"`
+	Otp             string             `json:"otp" bson:"otp"`
+	OtpExpires      time.Time          `json:"otp_expires" bson:"otp_expires"`
+	Verified        bool               `json:"verified" bson:"verified"`
+	GoogleLogin     bool               `json:"google_login" bson:"google_login"`
+	LastSeen        *time.Time         `json:"last_seen,omitempty" bson:"last_seen,omitempty"`
+	Status          string             `json:"status,omitempty" bson:"status,omitempty"`
+	StatusText      string             `json:"status_text,omitempty" bson:"status_text,omitempty"`
+	StatusExpiresAt *time.Time         `json:"status_expires_at,omitempty" bson:"status_expires_at,omitempty"`
+	BlockedUsers    []string           `json:"blocked_users,omitempty" bson:"blocked_users,omitempty"`
 }
+
+const (
+	StatusAvailable    = "available"
+	StatusAway         = "away"
+	StatusDoNotDisturb = "dnd"
+	// StatusInvisible users appear offline to everyone else but keep
+	// receiving messages.
+	StatusInvisible = "invisible"
+)
+
 type UserRegisterReq struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required"`
@@ -27,26 +42,186 @@ type UserLoginReq struct {
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+var roleRanks = map[string]int{RoleMember: 1, RoleAdmin: 2, RoleOwner: 3}
+
+// RoleRank orders roles so they can be compared; unknown roles rank lowest.
+func RoleRank(role string) int {
+	return roleRanks[role]
+}
+
 type Participant struct {
-	Id       string `json:"id" bson:"id"`
-	Username string `json:"username" bson:"username"`
-	Email    string `json:"email" bson:"email"`
-	Image    string `json:"image" bson:"image"`
+	Id       string    `json:"id" bson:"id"`
+	Username string    `json:"username" bson:"username"`
+	Email    string    `json:"email" bson:"email"`
+	Image    string    `json:"image" bson:"image"`
+	Role     string    `json:"role" bson:"role"`
+	JoinedAt time.Time `json:"joined_at" bson:"joined_at"`
+	// LastReadMessageId and LastReadAt only ever move forward; everything
+	// after LastReadAt from someone else counts as unread.
+	LastReadMessageId string    `json:"last_read_message_id,omitempty" bson:"last_read_message_id,omitempty"`
+	LastReadAt        time.Time `json:"last_read_at" bson:"last_read_at"`
+	// LastDeliveredMessageId and LastDeliveredAt track the newest message
+	// one of the participant's devices acknowledged receiving.
+	LastDeliveredMessageId string    `json:"last_delivered_message_id,omitempty" bson:"last_delivered_message_id,omitempty"`
+	LastDeliveredAt        time.Time `json:"last_delivered_at" bson:"last_delivered_at"`
 }
 type Conversation struct {
 	Id           primitive.ObjectID `json:"_id" bson:"_id"`
+	IsGroup      bool               `json:"is_group" bson:"is_group"`
+	Name         string             `json:"name,omitempty" bson:"name,omitempty"`
+	Image        string             `json:"image,omitempty" bson:"image,omitempty"`
+	CreatedBy    string             `json:"created_by" bson:"created_by"`
 	Participants []Participant      `json:"participants" bson:"participants"`
 	LastMessage  *Message           `json:"last_message" bson:"last_message"`
 	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
 	UpdatedAt    time.Time          `json:"updated_at" bson:"updated_at"`
 	RoomId       string             `json:"room_id" bson:"room_id"`
+	UnreadCount  int                `json:"unread_count" bson:"unread_count,omitempty"`
+	// DirectKey identifies the pair of users in a one-to-one conversation,
+	// so each pair has at most one. Groups leave it empty.
+	DirectKey string `json:"-" bson:"direct_key,omitempty"`
+}
+
+// DirectKey returns the same key for a pair of users whichever order they
+// are given in.
+func DirectKey(userId, otherId string) string {
+	if otherId < userId {
+		userId, otherId = otherId, userId
+	}
+	return userId + ":" + otherId
+}
+
+// Participant returns the member with the given user ID, or nil if the user
+// is not part of the conversation. Members stored before roles existed get
+// owner if they created the conversation and member otherwise.
+func (c *Conversation) Participant(userId string) *Participant {
+	for i := range c.Participants {
+		p := &c.Participants[i]
+		if p.Id != userId {
+			continue
+		}
+		if p.Role == "" {
+			p.Role = RoleMember
+			if c.IsGroup && c.CreatedBy == userId {
+				p.Role = RoleOwner
+			}
+		}
+		return p
+	}
+	return nil
+}
+
+// IsAdmin reports whether the user may moderate the conversation.
+func (c *Conversation) IsAdmin(userId string) bool {
+	p := c.Participant(userId)
+	return p != nil && RoleRank(p.Role) >= RoleRank(RoleAdmin)
 }
 
+type CreateGroupReq struct {
+	Name      string   `json:"name" binding:"required"`
+	Image     string   `json:"image"`
+	MemberIds []string `json:"member_ids" binding:"required"`
+}
+type AddMembersReq struct {
+	UserIds []string `json:"user_ids" binding:"required"`
+}
+type UpdateGroupReq struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+type UpdateRoleReq struct {
+	Role string `json:"role" binding:"required"`
+}
+
+const (
+	MessageTypeText       = "text"
+	MessageTypeSystem     = "system"
+	MessageTypeRoleChange = "role_change"
+)
+
 type Message struct {
-	Id        primitive.ObjectID `json:"_id" bson:"_id"`
-	RoomId    string             `json:"room_id" bson:"room_id"`
-	Username  string             `json:"username" bson:"username"`
-	Content   string             `json:"content" bson:"content"`
-	UserId    string             `json:"user_id" bson:"user_id"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	Id       primitive.ObjectID `json:"_id" bson:"_id"`
+	RoomId   string             `json:"room_id" bson:"room_id"`
+	Type     string             `json:"type" bson:"type"`
+	Username string             `json:"username" bson:"username"`
+	Content  string             `json:"content" bson:"content"`
+	UserId   string             `json:"user_id" bson:"user_id"`
+	// ClientId is chosen by the sending client so a retried send is stored
+	// only once.
+	ClientId string `json:"client_id,omitempty" bson:"client_id,omitempty"`
+	// Announced is set once the message was broadcast, so a retried send
+	// knows whether it still has to be.
+	Announced bool `json:"-" bson:"announced,omitempty"`
+	// ReplyTo quotes the message this one answers inline.
+	ReplyTo *MessagePreview `json:"reply_to,omitempty" bson:"reply_to,omitempty"`
+	// ThreadId is the _id of the thread root for replies posted in a thread.
+	// Thread replies stay out of the room timeline.
+	ThreadId string `json:"thread_id,omitempty" bson:"thread_id,omitempty"`
+	// ReplyCount, LastReplyAt and ThreadParticipants are kept on a thread
+	// root. ThreadParticipants lists everyone who replied.
+	ReplyCount         int               `json:"reply_count,omitempty" bson:"reply_count,omitempty"`
+	LastReplyAt        *time.Time        `json:"last_reply_at,omitempty" bson:"last_reply_at,omitempty"`
+	ThreadParticipants []string          `json:"thread_participants,omitempty" bson:"thread_participants,omitempty"`
+	Meta               map[string]string `json:"meta,omitempty" bson:"meta,omitempty"`
+	Reactions          []Reaction        `json:"reactions,omitempty" bson:"reactions,omitempty"`
+	Attachments        []Attachment      `json:"attachments,omitempty" bson:"attachments,omitempty"`
+	Edited             bool              `json:"edited" bson:"edited"`
+	EditedAt           *time.Time        `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	EditHistory        []MessageEdit     `json:"edit_history,omitempty" bson:"edit_history,omitempty"`
+	Deleted            bool              `json:"deleted" bson:"deleted"`
+	DeletedBy          string            `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
+	DeletedAt          *time.Time        `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	CreatedAt          time.Time         `json:"created_at" bson:"created_at"`
+}
+
+// Attachment is a file uploaded to a conversation. It is stored on its own
+// when uploaded and copied into the message it is sent with. Width and
+// Height are only known for images.
+type Attachment struct {
+	Id         primitive.ObjectID `json:"_id" bson:"_id"`
+	RoomId     string             `json:"-" bson:"room_id"`
+	UploadedBy string             `json:"-" bson:"uploaded_by"`
+	Name       string             `json:"name" bson:"name"`
+	Size       int64              `json:"size" bson:"size"`
+	Type       string             `json:"type" bson:"type"`
+	URL        string             `json:"url" bson:"url"`
+	Key        string             `json:"-" bson:"key"`
+	Width      int                `json:"width,omitempty" bson:"width,omitempty"`
+	Height     int                `json:"height,omitempty" bson:"height,omitempty"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Reaction groups everyone who reacted to a message with one emoji, in the
+// order they reacted.
+type Reaction struct {
+	Emoji   string   `json:"emoji" bson:"emoji"`
+	Count   int      `json:"count" bson:"count"`
+	UserIds []string `json:"user_ids" bson:"user_ids"`
+}
+
+// MessagePreview is the quoted part of a replied-to message. It follows
+// edits and deletes of the original.
+type MessagePreview struct {
+	Id       primitive.ObjectID `json:"_id" bson:"_id"`
+	UserId   string             `json:"user_id" bson:"user_id"`
+	Username string             `json:"username" bson:"username"`
+	Content  string             `json:"content" bson:"content"`
+	Deleted  bool               `json:"deleted,omitempty" bson:"deleted,omitempty"`
+}
+
+// MessageEdit is the content a message had before an edit replaced it.
+type MessageEdit struct {
+	Content  string    `json:"content" bson:"content"`
+	EditedBy string    `json:"edited_by" bson:"edited_by"`
+	EditedAt time.Time `json:"edited_at" bson:"edited_at"`
+}
+type EditMessageReq struct {
+	Content string `json:"content" binding:"required"`
 }
@@ -5,6 +5,7 @@ import (
 	user "chat-server/internal/users"
 	"chat-server/internal/ws"
 	"chat-server/middleware"
+	"chat-server/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,15 +17,33 @@ func SocialRRoutes(incomingRoutes *gin.Engine) {
 func UserRoutes(incomingRoutes *gin.Engine) {
 	incomingRoutes.POST("/register", user.RegisterUser())
 	incomingRoutes.POST("/login", user.LoginUser())
-	incomingRoutes.GET("/users/search" /*middleware.Authenticate(),*/, user.GetUserByEmail())
+	incomingRoutes.GET("/users/search", middleware.Authenticate(), user.SearchUsers())
+	incomingRoutes.POST("/users/:user_id/block", middleware.Authenticate(), user.BlockUser())
+	incomingRoutes.DELETE("/users/:user_id/block", middleware.Authenticate(), user.BlockUser())
 	incomingRoutes.POST("/verify_otp", user.VerifyOtp())
 	incomingRoutes.POST("/upload_image", middleware.Authenticate(), user.UploadHandler)
+	incomingRoutes.GET("/files/*key", conversation.AuthorizeFile(), services.ServeFile())
 }
 
 func ChatRoutes(incomingRoutes *gin.Engine, wss *ws.Hub) {
 	incomingRoutes.POST("/create_room/:user_id", middleware.Authenticate(), conversation.AddUserToConversation())
 	incomingRoutes.GET("/conversation", middleware.Authenticate(), conversation.GetConversationByUserId())
-	incomingRoutes.GET("/join_room/:room_id", wss.HandleJoinRoom)
+	incomingRoutes.POST("/create_group", middleware.Authenticate(), conversation.CreateGroup(wss))
+	incomingRoutes.POST("/groups/:room_id/members", middleware.Authenticate(), conversation.AddGroupMembers(wss))
+	incomingRoutes.DELETE("/groups/:room_id/members/:user_id", middleware.Authenticate(), conversation.RemoveGroupMember(wss))
+	incomingRoutes.POST("/groups/:room_id/leave", middleware.Authenticate(), conversation.LeaveGroup(wss))
+	incomingRoutes.PUT("/groups/:room_id", middleware.Authenticate(), conversation.UpdateGroup(wss))
+	incomingRoutes.PUT("/groups/:room_id/members/:user_id/role", middleware.Authenticate(), conversation.UpdateMemberRole(wss))
+	incomingRoutes.PUT("/rooms/:room_id/messages/:message_id", middleware.Authenticate(), conversation.EditMessage(wss))
+	incomingRoutes.GET("/rooms/:room_id/messages/:message_id/history", middleware.Authenticate(), conversation.GetMessageHistory())
+	incomingRoutes.GET("/rooms/:room_id/messages/:message_id/thread", middleware.Authenticate(), conversation.GetThreadMessages())
+	incomingRoutes.PUT("/rooms/:room_id/messages/:message_id/reactions/:emoji", middleware.Authenticate(), conversation.ReactToMessage(wss))
+	incomingRoutes.DELETE("/rooms/:room_id/messages/:message_id/reactions/:emoji", middleware.Authenticate(), conversation.ReactToMessage(wss))
+	incomingRoutes.DELETE("/rooms/:room_id/messages/:message_id", middleware.Authenticate(), conversation.DeleteMessage(wss))
+	incomingRoutes.POST("/rooms/:room_id/attachments", middleware.Authenticate(), conversation.UploadAttachment())
 	incomingRoutes.GET("/get_room_messages/:room_id", middleware.Authenticate(), conversation.GetRoomMessages())
-	incomingRoutes.GET("/ws/join_app", ws.EnterApp)
+	incomingRoutes.GET("/search/messages", middleware.Authenticate(), conversation.SearchMessages())
+	incomingRoutes.GET("/ws", middleware.AuthenticateWs(), wss.ServeWs)
+	incomingRoutes.GET("/presence", middleware.Authenticate(), wss.GetPresence)
+	incomingRoutes.PUT("/status", middleware.Authenticate(), wss.UpdateStatus)
 }
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inlineTypes are the only types shown in the browser. Everything else,
+// HTML and SVG included, is sent as a download so an upload cannot run
+// script on the API's origin.
+var inlineTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// SniffType detects a file's content type from its first bytes and leaves
+// the file rewound. Uploads are stored with this type rather than the one
+// the client claims.
+func SniffType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	return contentType, nil
+}
+
+// IsImage reports whether files of contentType are displayed inline.
+func IsImage(contentType string) bool {
+	return inlineTypes[contentType]
+}
+
+// downloadDisposition makes the browser save the file under key instead of
+// showing it.
+func downloadDisposition(key string) string {
+	return `attachment; filename="` + strings.ReplaceAll(path.Base(key), `"`, "") + `"`
+}
+
+// ServeFile downloads stored files. The local and memory backends are read
+// here; S3 files are redirected to a presigned URL. Either way it runs after
+// AuthorizeFile has checked the request.
+func ServeFile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		storage, err := DefaultStorage()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage is unavailable", "message": err.Error()})
+			return
+		}
+		key := CleanKey(c.Param("key"))
+		if presigner, ok := storage.(Presigner); ok {
+			link, err := presigner.Presign(c.Request.Context(), key)
+			if err == ErrNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file", "message": err.Error()})
+				return
+			}
+			c.Header("Cache-Control", "no-store")
+			c.Redirect(http.StatusFound, link)
+			return
+		}
+		opener, ok := storage.(Opener)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		object, err := opener.Open(c.Request.Context(), key)
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file", "message": err.Error()})
+			return
+		}
+		defer object.Close()
+		contentType := object.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("X-Content-Type-Options", "nosniff")
+		if !IsImage(contentType) {
+			c.Header("Content-Disposition", downloadDisposition(key))
+		}
+		http.ServeContent(c.Writer, c.Request, "", object.ModTime, object)
+	}
+}
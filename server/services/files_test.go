@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSniffType(t *testing.T) {
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", picture.Bytes(), "image/png"},
+		{"pdf", []byte("%PDF-1.7\n..."), "application/pdf"},
+		{"text", []byte("just some notes"), "text/plain"},
+		{"html", []byte("<!DOCTYPE html><script>alert(1)</script>"), "text/html"},
+		{"empty", nil, "text/plain"},
+	} {
+		file := bytes.NewReader(tc.data)
+		got, err := SniffType(file)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		rest, _ := io.ReadAll(file)
+		if !bytes.Equal(rest, tc.data) {
+			t.Errorf("%s: file was not rewound", tc.name)
+		}
+	}
+}
+
+// TestServeFile checks both backends serve the stored type, and only images
+// inline.
+func TestServeFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for name, storage := range map[string]Storage{
+		"local":  NewLocalStorage(t.TempDir(), "http://localhost:8080/files"),
+		"memory": NewMemoryStorage("http://localhost:8080/files"),
+	} {
+		defaultStorageMu.Lock()
+		defaultStorage = storage
+		defaultStorageMu.Unlock()
+		ctx := context.Background()
+		storage.Put(ctx, "avatar", strings.NewReader("\x89PNG\r\n\x1a\n"), "image/png")
+		storage.Put(ctx, "attachments/r1/a/page.html", strings.NewReader("<script>alert(1)</script>"), "text/html")
+		if _, err := storage.Put(ctx, "../../escape", strings.NewReader("x"), "text/plain"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		router := gin.New()
+		router.GET("/files/*key", ServeFile())
+		get := func(path string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+			return recorder
+		}
+
+		avatar := get("/files/avatar")
+		if avatar.Code != http.StatusOK || avatar.Header().Get("Content-Type") != "image/png" || avatar.Header().Get("Content-Disposition") != "" {
+			t.Errorf("%s: avatar served as %d %q %q", name, avatar.Code, avatar.Header().Get("Content-Type"), avatar.Header().Get("Content-Disposition"))
+		}
+		page := get("/files/attachments/r1/a/page.html")
+		if page.Code != http.StatusOK || !strings.HasPrefix(page.Header().Get("Content-Disposition"), "attachment") || page.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: html served inline: %v", name, page.Header())
+		}
+		if code := get("/files/escape").Code; code != http.StatusOK {
+			t.Errorf("%s: cleaned key not found: %d", name, code)
+		}
+		if code := get("/files/missing").Code; code != http.StatusNotFound {
+			t.Errorf("%s: missing file: got %d, want 404", name, code)
+		}
+	}
+	defaultStorageMu.Lock()
+	defaultStorage = nil
+	defaultStorageMu.Unlock()
+}
+
+// presignedStorage stands in for S3, linking every file but "missing".
+type presignedStorage struct{}
+
+func (presignedStorage) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	return fileURL("http://localhost:8080/files", key), nil
+}
+
+func (presignedStorage) Presign(ctx context.Context, key string) (string, error) {
+	if key == "missing" {
+		return "", ErrNotFound
+	}
+	return "https://bucket.example/" + key + "?signed", nil
+}
+
+// TestServeFilePresigned checks presigning backends are redirected to.
+func TestServeFilePresigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defaultStorageMu.Lock()
+	defaultStorage = presignedStorage{}
+	defaultStorageMu.Unlock()
+	router := gin.New()
+	router.GET("/files/*key", ServeFile())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/files/attachments/r1/a/x.pdf", nil))
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "https://bucket.example/attachments/r1/a/x.pdf?signed" {
+		t.Errorf("got %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/files/missing", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("missing file: got %d, want 404", recorder.Code)
+	}
+}
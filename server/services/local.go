@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage keeps files in a directory on disk: the data under files/
+// and each file's content type under types/, by the same key.
+type LocalStorage struct {
+	dir       string
+	publicURL string
+}
+
+func NewLocalStorage(dir string, publicURL string) *LocalStorage {
+	return &LocalStorage{dir: dir, publicURL: publicURL}
+}
+
+func (s *LocalStorage) path(tree string, key string) string {
+	return filepath.Join(s.dir, tree, filepath.FromSlash(CleanKey(key)))
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	key = CleanKey(key)
+	if key == "" {
+		return "", errors.New("file key is required")
+	}
+	if err := writeFile(s.path("files", key), body); err != nil {
+		return "", err
+	}
+	if err := writeFile(s.path("types", key), strings.NewReader(contentType)); err != nil {
+		return "", err
+	}
+	return fileURL(s.publicURL, key), nil
+}
+
+// writeFile writes beside the final name first so a failed upload never
+// replaces a file.
+func writeFile(name string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *LocalStorage) Open(ctx context.Context, key string) (*Object, error) {
+	file, err := os.Open(s.path("files", key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrNotFound
+	}
+	// A file without a recorded type is served as a download.
+	contentType, _ := os.ReadFile(s.path("types", key))
+	return &Object{ReadSeekCloser: file, ContentType: string(contentType), ModTime: info.ModTime()}, nil
+}
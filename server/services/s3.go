@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// presignExpiry is how long a link handed out by Presign works.
+const presignExpiry = 15 * time.Minute
+
+// S3Storage keeps files in an S3 bucket, which can stay private. Files are
+// linked under /files like the other backends, and ServeFile redirects
+// there to a short-lived presigned URL.
+type S3Storage struct {
+	client    *s3.Client
+	presigner *s3.PresignClient
+	uploader  *manager.Uploader
+	bucket    string
+	publicURL string
+}
+
+// NewS3Storage uploads to the S3_BUCKET bucket, gochatappimages by default,
+// and links files under publicURL. Credentials come from the usual AWS
+// environment; AWS_REGION defaults to us-east-1. Setting S3_ENDPOINT sends
+// requests to an S3-compatible server such as MinIO instead, using
+// path-style URLs.
+func NewS3Storage(ctx context.Context, publicURL string) (*S3Storage, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	svc := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		bucket = "gochatappimages"
+	}
+	return &S3Storage{
+		client:    svc,
+		presigner: s3.NewPresignClient(svc),
+		uploader:  manager.NewUploader(svc),
+		bucket:    bucket,
+		publicURL: publicURL,
+	}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fileURL(s.publicURL, key), nil
+}
+
+// Presign returns a link that reads key straight from the bucket for a few
+// minutes. Files that are not images are sent as downloads, as ServeFile
+// does for the other backends.
+func (s *S3Storage) Presign(ctx context.Context, key string) (string, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	input := &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+	if !IsImage(aws.ToString(head.ContentType)) {
+		input.ResponseContentDisposition = aws.String(downloadDisposition(key))
+	}
+	request, err := s.presigner.PresignGetObject(ctx, input, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return "", err
+	}
+	return request.URL, nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage keeps uploaded files. Put stores body under key and returns the
+// URL it can be downloaded from.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error)
+}
+
+// Opener is implemented by backends whose files are read back and served
+// by this server under /files.
+type Opener interface {
+	Open(ctx context.Context, key string) (*Object, error)
+}
+
+// Presigner is implemented by backends whose files are linked under /files
+// but downloaded from the backend, through a short-lived URL handed out
+// once the request is allowed.
+type Presigner interface {
+	Presign(ctx context.Context, key string) (string, error)
+}
+
+// Object is a stored file being read back.
+type Object struct {
+	io.ReadSeekCloser
+	ContentType string
+	ModTime     time.Time
+}
+
+var ErrNotFound = errors.New("file not found")
+
+var (
+	defaultStorage   Storage
+	defaultStorageMu sync.Mutex
+)
+
+// DefaultStorage returns the backend chosen by StorageFromEnv, creating it
+// on first use. A failed setup is retried on the next call.
+func DefaultStorage() (Storage, error) {
+	defaultStorageMu.Lock()
+	defer defaultStorageMu.Unlock()
+	if defaultStorage != nil {
+		return defaultStorage, nil
+	}
+	storage, err := StorageFromEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defaultStorage = storage
+	return storage, nil
+}
+
+// StorageFromEnv picks the backend named by STORAGE_BACKEND: "s3" (the
+// default), "local" or "memory". Local files are written under STORAGE_DIR,
+// ./uploads by default. Files are linked through STORAGE_PUBLIC_URL,
+// http://localhost:8080/files by default.
+func StorageFromEnv(ctx context.Context) (Storage, error) {
+	publicURL := os.Getenv("STORAGE_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080/files"
+	}
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalStorage(dir, publicURL), nil
+	case "memory":
+		return NewMemoryStorage(publicURL), nil
+	case "s3", "":
+		return NewS3Storage(ctx, publicURL)
+	default:
+		log.Println("Unknown STORAGE_BACKEND", backend, "using s3")
+		return NewS3Storage(ctx, publicURL)
+	}
+}
+
+// CleanKey strips anything from key that could climb out of the storage
+// root, such as ".." segments. Every backend stores and looks files up by
+// the cleaned key.
+func CleanKey(key string) string {
+	var parts []string
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// fileURL links to key under base, escaping each path segment.
+func fileURL(base string, key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(parts, "/")
+}
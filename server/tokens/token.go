@@ -21,12 +21,18 @@ var UserData = db.UserData(db.Client, "users")
 var SECRET_KEY string
 
 func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file:", err)
-	}
+	// A missing .env is reported by the db package; the key may come from
+	// the environment instead. The server checks it is set with RequireSecret.
+	godotenv.Load()
 	SECRET_KEY = os.Getenv("SECRET_KEY") // Replace with your actual secret key
 }
+
+// RequireSecret stops the server if no signing key is configured.
+func RequireSecret() {
+	if SECRET_KEY == "" {
+		log.Fatal("SECRET_KEY is not set")
+	}
+}
 func GenerateToken(email, userId, username string) (string, error) {
 	claims := &SignedDetails{
 		UserId:   userId,